@@ -0,0 +1,231 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+)
+
+const aviFlagHasIndex = 0x10
+
+const aviIndexKeyFrame = 0x10
+
+type aviIndexEntry struct {
+	offset uint32
+	size   uint32
+}
+
+// aviWriter writes a Motion JPEG AVI file, sizes and frame counts are patched on close
+type aviWriter struct {
+	file      *os.File
+	frameRate int
+	frames    int
+	maxSize   int
+	index     []aviIndexEntry
+	position  int64
+	moviStart int64
+	// offsets of the header fields only known at the end
+	riffSizeOffset     int64
+	totalFramesOffset  int64
+	bufferSizeOffset   int64
+	streamLengthOffset int64
+	streamBufferOffset int64
+	moviSizeOffset     int64
+}
+
+// newAviWriter creates the file right away, the frame size is set by setFrameSize before the first frame
+func newAviWriter(path string, frameRate int) (*aviWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &aviWriter{file: file, frameRate: frameRate}
+	data := w.header(0, 0)
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return nil, err
+	}
+	w.position = int64(len(data))
+	return w, nil
+}
+
+// setFrameSize writes the header again with the frame size, its length does not depend on it
+func (w *aviWriter) setFrameSize(width int, height int) error {
+	_, err := w.file.WriteAt(w.header(width, height), 0)
+	return err
+}
+
+// header returns the headers up to the movi list, the fields only known at the end are left to close
+func (w *aviWriter) header(width int, height int) []byte {
+	frameRate := w.frameRate
+	var header bytes.Buffer
+	le := func(value uint32) {
+		binary.Write(&header, binary.LittleEndian, value)
+	}
+	le16 := func(value uint16) {
+		binary.Write(&header, binary.LittleEndian, value)
+	}
+	offset := func() int64 {
+		return int64(header.Len())
+	}
+
+	header.WriteString("RIFF")
+	w.riffSizeOffset = offset()
+	le(0)
+	header.WriteString("AVI ")
+
+	header.WriteString("LIST")
+	hdrlSizeOffset := offset()
+	le(0)
+	header.WriteString("hdrl")
+
+	header.WriteString("avih")
+	le(56)
+	le(uint32(1000000 / frameRate))
+	le(0)
+	le(0)
+	le(aviFlagHasIndex)
+	w.totalFramesOffset = offset()
+	le(0)
+	le(0)
+	le(1)
+	w.bufferSizeOffset = offset()
+	le(0)
+	le(uint32(width))
+	le(uint32(height))
+	le(0)
+	le(0)
+	le(0)
+	le(0)
+
+	header.WriteString("LIST")
+	strlSizeOffset := offset()
+	le(0)
+	header.WriteString("strl")
+
+	header.WriteString("strh")
+	le(56)
+	header.WriteString("vids")
+	header.WriteString("MJPG")
+	le(0)
+	le16(0)
+	le16(0)
+	le(0)
+	le(1)
+	le(uint32(frameRate))
+	le(0)
+	w.streamLengthOffset = offset()
+	le(0)
+	w.streamBufferOffset = offset()
+	le(0)
+	le(0xffffffff)
+	le(0)
+	le16(0)
+	le16(0)
+	le16(uint16(width))
+	le16(uint16(height))
+
+	header.WriteString("strf")
+	le(40)
+	le(40)
+	le(uint32(width))
+	le(uint32(height))
+	le16(1)
+	le16(24)
+	header.WriteString("MJPG")
+	le(uint32(width * height * 3))
+	le(0)
+	le(0)
+	le(0)
+	le(0)
+	hdrlEnd := offset()
+
+	header.WriteString("LIST")
+	w.moviSizeOffset = offset()
+	le(0)
+	w.moviStart = offset()
+	header.WriteString("movi")
+
+	data := header.Bytes()
+	binary.LittleEndian.PutUint32(data[hdrlSizeOffset:], uint32(hdrlEnd-hdrlSizeOffset-4))
+	binary.LittleEndian.PutUint32(data[strlSizeOffset:], uint32(hdrlEnd-strlSizeOffset-4))
+	return data
+}
+
+func (w *aviWriter) writeFrame(jpegData []byte) error {
+	var chunk bytes.Buffer
+	chunk.WriteString("00dc")
+	binary.Write(&chunk, binary.LittleEndian, uint32(len(jpegData)))
+	chunk.Write(jpegData)
+	if len(jpegData)%2 == 1 {
+		chunk.WriteByte(0)
+	}
+	if _, err := w.file.Write(chunk.Bytes()); err != nil {
+		return err
+	}
+	w.index = append(w.index, aviIndexEntry{
+		offset: uint32(w.position - w.moviStart),
+		size:   uint32(len(jpegData)),
+	})
+	w.position += int64(chunk.Len())
+	w.frames++
+	if len(jpegData) > w.maxSize {
+		w.maxSize = len(jpegData)
+	}
+	return nil
+}
+
+func (w *aviWriter) close() error {
+	moviEnd := w.position
+	var index bytes.Buffer
+	index.WriteString("idx1")
+	binary.Write(&index, binary.LittleEndian, uint32(len(w.index)*16))
+	for _, entry := range w.index {
+		index.WriteString("00dc")
+		binary.Write(&index, binary.LittleEndian, uint32(aviIndexKeyFrame))
+		binary.Write(&index, binary.LittleEndian, entry.offset)
+		binary.Write(&index, binary.LittleEndian, entry.size)
+	}
+	if _, err := w.file.Write(index.Bytes()); err != nil {
+		w.file.Close()
+		return err
+	}
+	fileEnd := moviEnd + int64(index.Len())
+
+	patches := []struct {
+		offset int64
+		value  uint32
+	}{
+		{w.riffSizeOffset, uint32(fileEnd - 8)},
+		{w.totalFramesOffset, uint32(w.frames)},
+		{w.bufferSizeOffset, uint32(w.maxSize + 8)},
+		{w.streamLengthOffset, uint32(w.frames)},
+		{w.streamBufferOffset, uint32(w.maxSize + 8)},
+		{w.moviSizeOffset, uint32(moviEnd - w.moviStart)},
+	}
+	for _, patch := range patches {
+		var value [4]byte
+		binary.LittleEndian.PutUint32(value[:], patch.value)
+		if _, err := w.file.WriteAt(value[:], patch.offset); err != nil {
+			w.file.Close()
+			return err
+		}
+	}
+	return w.file.Close()
+}
@@ -0,0 +1,123 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type aviChunk struct {
+	id    string
+	start int
+	data  []byte
+}
+
+// readChunks splits data into its RIFF chunks, start is the offset of each chunk id in the file
+func readChunks(t *testing.T, data []byte, base int) []aviChunk {
+	var chunks []aviChunk
+	for i := 0; i < len(data); {
+		if i+8 > len(data) {
+			t.Fatalf("truncated chunk header at %d", base+i)
+		}
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		if i+8+size > len(data) {
+			t.Fatalf("chunk %q at %d overflows its parent", data[i:i+4], base+i)
+		}
+		chunks = append(chunks, aviChunk{id: string(data[i : i+4]), start: base + i, data: data[i+8 : i+8+size]})
+		i += 8 + size + size%2
+	}
+	return chunks
+}
+
+func TestAviWriterStructure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.avi")
+	avi, err := newAviWriter(path, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = avi.setFrameSize(32, 24); err != nil {
+		t.Fatal(err)
+	}
+	// odd lengths exercise the padding byte
+	frames := [][]byte{[]byte("first"), []byte("second"), []byte("third!!")}
+	for _, frame := range frames {
+		if err = avi.writeFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = avi.close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data[0:4]) != "RIFF" || string(data[8:12]) != "AVI " {
+		t.Fatalf("bad RIFF header %q", data[:12])
+	}
+	if size := int(binary.LittleEndian.Uint32(data[4:])); size != len(data)-8 {
+		t.Fatalf("RIFF size %d, file holds %d", size, len(data)-8)
+	}
+	chunks := readChunks(t, data[12:], 12)
+	if len(chunks) != 3 || chunks[0].id != "LIST" || chunks[1].id != "LIST" || chunks[2].id != "idx1" {
+		t.Fatalf("unexpected top level chunks %v", chunks)
+	}
+	hdrl, movi, idx1 := chunks[0], chunks[1], chunks[2]
+	if string(hdrl.data[:4]) != "hdrl" || string(movi.data[:4]) != "movi" {
+		t.Fatalf("unexpected lists %q %q", hdrl.data[:4], movi.data[:4])
+	}
+
+	avih := readChunks(t, hdrl.data[4:], hdrl.start+12)[0]
+	if avih.id != "avih" {
+		t.Fatalf("hdrl starts with %q", avih.id)
+	}
+	if total := binary.LittleEndian.Uint32(avih.data[16:]); total != uint32(len(frames)) {
+		t.Fatalf("avih total frames %d, want %d", total, len(frames))
+	}
+	if width, height := binary.LittleEndian.Uint32(avih.data[32:]), binary.LittleEndian.Uint32(avih.data[36:]); width != 32 || height != 24 {
+		t.Fatalf("avih size %dx%d", width, height)
+	}
+
+	moviStart := movi.start + 8
+	frameChunks := readChunks(t, movi.data[4:], moviStart+4)
+	if len(frameChunks) != len(frames) {
+		t.Fatalf("movi holds %d chunks, want %d", len(frameChunks), len(frames))
+	}
+	if len(idx1.data) != 16*len(frames) {
+		t.Fatalf("idx1 holds %d bytes for %d frames", len(idx1.data), len(frames))
+	}
+	for i, frame := range frames {
+		entry := idx1.data[i*16 : i*16+16]
+		offset := int(binary.LittleEndian.Uint32(entry[8:]))
+		size := int(binary.LittleEndian.Uint32(entry[12:]))
+		if string(entry[:4]) != "00dc" || binary.LittleEndian.Uint32(entry[4:]) != aviIndexKeyFrame {
+			t.Fatalf("bad index entry %d %q", i, entry[:8])
+		}
+		// offsets are relative to the movi fourcc
+		if moviStart+offset != frameChunks[i].start || size != len(frame) {
+			t.Fatalf("index entry %d points at %d size %d, chunk at %d", i, moviStart+offset, size, frameChunks[i].start)
+		}
+		if frameChunks[i].id != "00dc" || !bytes.Equal(frameChunks[i].data, frame) {
+			t.Fatalf("frame %d holds %q", i, frameChunks[i].data)
+		}
+	}
+}
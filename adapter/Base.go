@@ -27,7 +27,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
 )
 
 func initProtocolAdapter(adapter *Adapter, version string) *protocolAdapter {
@@ -50,8 +50,16 @@ func initProtocolAdapter(adapter *Adapter, version string) *protocolAdapter {
 		}
 		if major > 12 || major >= 12 && minor >= 2 {
 			initIOS12(protocol)
+			protocol.emulation.nativeUserAgent = true
+			protocol.emulation.nativeScreenSize = major >= 13
+			protocol.newDocumentScripts.native = major >= 13
+			protocol.runtime.nativeAwaitPromise = true
+			protocol.runtime.nativeAwaitParameter = major >= 13
 			return protocol
 		}
+		initIOS9(protocol)
+		protocol.runtime.nativeAwaitPromise = major >= 11
+		return protocol
 	}
 	initIOS9(protocol)
 	return protocol
@@ -64,8 +72,22 @@ type protocolAdapter struct {
 	lastNodeId                 int64
 	lastPageExecutionContextId int64
 	styleMap                   map[string]interface{}
-	lastScriptEval             interface{}
 	screencast                 *screencastSession
+	screencastLock             sync.Mutex
+	navigation                 *navigationHistory
+	lifecycle                  *lifecycleTracker
+	network                    *networkDomain
+	emulation                  *deviceEmulation
+	newDocumentScripts         *newDocumentScripts
+	emulatedMedia              *emulatedMedia
+	runtime                    *runtimeSupport
+	console                    *consoleMessages
+	pageChannel                *pageChannel
+	executionContexts          *executionContexts
+	collectionEntries          *collectionEntries
+	compiledScripts            *compiledScripts
+	globalScripts              *globalScripts
+	bindings                   *runtimeBindings
 	mapSelectorList            mapSelectorListFunc
 }
 
@@ -74,6 +96,20 @@ func (p *protocolAdapter) init() {
 
 	}
 	p.styleMap = make(map[string]interface{})
+	p.navigation = newNavigationHistory()
+	p.lifecycle = newLifecycleTracker(p.adapter)
+	p.network = &networkDomain{}
+	p.emulation = newDeviceEmulation()
+	p.newDocumentScripts = newNewDocumentScripts()
+	p.emulatedMedia = newEmulatedMedia()
+	p.runtime = &runtimeSupport{}
+	p.console = &consoleMessages{}
+	p.pageChannel = newPageChannel()
+	p.executionContexts = newExecutionContexts()
+	p.collectionEntries = newCollectionEntries()
+	p.compiledScripts = newCompiledScripts()
+	p.globalScripts = newGlobalScripts()
+	p.bindings = newRuntimeBindings()
 
 	p.adapter.AddToolMessageFilter("DOM.getDocument", p.onDomGetDocument)
 	// CSS
@@ -91,6 +127,23 @@ func (p *protocolAdapter) init() {
 	p.adapter.AddToolMessageFilter("Page.getNavigationHistory", p.onGetNavigationHistory)
 	p.adapter.AddToolMessageFilter("Page.setOverlayMessage", p.onPageSetOverlay)
 	p.adapter.AddToolMessageFilter("Page.configureOverlay", p.onPageConfigureOverlay)
+	p.adapter.AddToolMessageFilter("Page.navigateToHistoryEntry", p.onNavigateToHistoryEntry)
+	p.adapter.AddToolMessageFilter("Page.addScriptToEvaluateOnNewDocument", p.onAddScriptToEvaluateOnNewDocument)
+	p.adapter.AddToolMessageFilter("Page.removeScriptToEvaluateOnNewDocument", p.onRemoveScriptToEvaluateOnNewDocument)
+	p.adapter.AddToolMessageFilter("Page.addScriptToEvaluateOnLoad", p.onAddScriptToEvaluateOnNewDocument)
+	p.adapter.AddToolMessageFilter("Page.removeScriptToEvaluateOnLoad", p.onRemoveScriptToEvaluateOnNewDocument)
+	p.adapter.AddToolMessageFilter("Page.resetNavigationHistory", p.onResetNavigationHistory)
+	p.adapter.AddToolMessageFilter("Page.reload", p.onPageReload)
+	p.adapter.AddToolMessageFilter("Page.stopLoading", p.onStopLoading)
+	p.adapter.AddToolMessageFilter("Page.navigate", p.onPageNavigate)
+	p.adapter.AddToolMessageFilter("Page.setLifecycleEventsEnabled", p.onSetLifecycleEventsEnabled)
+	p.adapter.AddToolMessageFilter("Page.captureScreenshot", p.onCaptureScreenshot)
+
+	p.adapter.AddWebkitMessageFilter("Page.frameNavigated", p.onFrameNavigated)
+	p.adapter.AddWebkitMessageFilter("Page.frameDetached", p.onFrameDetached)
+	p.adapter.AddWebkitMessageFilter("Page.domContentEventFired", p.onDomContentEventFired)
+	p.adapter.AddWebkitMessageFilter("Page.loadEventFired", p.onLoadEventFired)
+	p.adapter.AddWebkitMessageFilter("Page.frameStoppedLoading", p.onFrameStoppedLoading)
 	// DOM
 	p.adapter.AddToolMessageFilter("DOM.enable", p.onDomEnable)
 	p.adapter.AddToolMessageFilter("DOM.setInspectMode", p.onSetInspectMode)
@@ -107,31 +160,71 @@ func (p *protocolAdapter) init() {
 	p.adapter.AddToolMessageFilter("Debugger.enable", p.onDebuggerEnable)
 
 	p.adapter.AddWebkitMessageFilter("Debugger.scriptParsed", p.onScriptParsed)
+	p.adapter.AddWebkitMessageFilter("Debugger.globalObjectCleared", p.onGlobalObjectCleared)
 	// Emulation
 	p.adapter.AddToolMessageFilter("Emulation.canEmulate", p.onCanEmulate)
 	p.adapter.AddToolMessageFilter("Emulation.setTouchEmulationEnabled", p.onEmulationSetTouchEmulationEnabled)
 	p.adapter.AddToolMessageFilter("Emulation.setScriptExecutionDisabled", p.onEmulationSetScriptExecutionDisabled)
 	p.adapter.AddToolMessageFilter("Emulation.setEmulatedMedia", p.onEmulationSetEmulatedMedia)
+	p.adapter.AddToolMessageFilter("Emulation.setAutoDarkModeOverride", p.onSetAutoDarkModeOverride)
+	p.adapter.AddToolMessageFilter("Emulation.setDeviceMetricsOverride", p.onSetDeviceMetricsOverride)
+	p.adapter.AddToolMessageFilter("Emulation.clearDeviceMetricsOverride", p.onClearDeviceMetricsOverride)
+	p.adapter.AddToolMessageFilter("Emulation.setUserAgentOverride", p.onSetUserAgentOverride)
+	p.adapter.AddToolMessageFilter("Emulation.setGeolocationOverride", p.onSetGeolocationOverride)
+	p.adapter.AddToolMessageFilter("Emulation.clearGeolocationOverride", p.onClearGeolocationOverride)
+	p.adapter.AddToolMessageFilter("Emulation.setTimezoneOverride", p.onSetTimezoneOverride)
+	p.adapter.AddToolMessageFilter("Emulation.setLocaleOverride", p.onSetLocaleOverride)
+	// DeviceOrientation
+	p.adapter.AddToolMessageFilter("DeviceOrientation.setDeviceOrientationOverride", p.onSetDeviceOrientationOverride)
+	p.adapter.AddToolMessageFilter("DeviceOrientation.clearDeviceOrientationOverride", p.onClearDeviceOrientationOverride)
 	// Rendering
 	p.adapter.AddToolMessageFilter("Rendering.setShowPaintRects", p.onRenderingSetShowPaintRects)
 	// Input
 	p.adapter.AddToolMessageFilter("Input.emulateTouchFromMouseEvent", p.onEmulateTouchFromMouseEvent)
+	p.adapter.AddToolMessageFilter("Input.dispatchMouseEvent", p.onDispatchMouseEvent)
+	p.adapter.AddToolMessageFilter("Input.dispatchTouchEvent", p.onDispatchTouchEvent)
+	p.adapter.AddToolMessageFilter("Input.dispatchKeyEvent", p.onDispatchKeyEvent)
+	p.adapter.AddToolMessageFilter("Input.insertText", p.onInsertText)
+	p.adapter.AddToolMessageFilter("Input.synthesizeTapGesture", p.onSynthesizeTapGesture)
+	p.adapter.AddToolMessageFilter("Input.synthesizeScrollGesture", p.onSynthesizeScrollGesture)
+	p.adapter.AddToolMessageFilter("Input.synthesizePinchGesture", p.onSynthesizePinchGesture)
 	// Log
 	p.adapter.AddToolMessageFilter("Log.clear", p.onLogClear)
 	p.adapter.AddToolMessageFilter("Log.disable", p.onLogDisable)
 	p.adapter.AddToolMessageFilter("Log.enable", p.onLogEnable)
 	// Console
 	p.adapter.AddWebkitMessageFilter("Console.messageAdded", p.onConsoleMessageAdded)
+	p.adapter.AddWebkitMessageFilter("Console.messageRepeatCountUpdated", p.onConsoleMessageRepeatCountUpdated)
 	// Network
+	p.adapter.AddToolMessageFilter("Network.enable", p.onNetworkEnable)
+	p.adapter.AddToolMessageFilter("Network.disable", p.onNetworkDisable)
 	p.adapter.AddToolMessageFilter("Network.getCookies", p.onNetworkGetCookies)
 	p.adapter.AddToolMessageFilter("Network.deleteCookie", p.onNetworkDeleteCookie)
 	p.adapter.AddToolMessageFilter("Network.setMonitoringXHREnabled", p.onNetworkSetMonitoringXHREnabled)
 	p.adapter.AddToolMessageFilter("Network.canEmulateNetworkConditions", p.onCanEmulateNetworkConditions)
+	p.adapter.AddToolMessageFilter("Network.setUserAgentOverride", p.onSetUserAgentOverride)
+
+	p.adapter.AddWebkitMessageFilter("Network.requestWillBeSent", p.onNetworkRequestWillBeSent)
+	p.adapter.AddWebkitMessageFilter("Network.loadingFinished", p.onNetworkLoadingFinished)
+	p.adapter.AddWebkitMessageFilter("Network.loadingFailed", p.onNetworkLoadingFailed)
+	for _, event := range networkEvents {
+		p.adapter.AddWebkitMessageFilter(event, p.toolNetworkEvent)
+	}
 	// Runtime
-	p.adapter.AddToolMessageFilter("Runtime.compileScript", p.onRuntimeOnCompileScript)
+	p.adapter.AddToolMessageFilter("Runtime.compileScript", p.onRuntimeCompileScript)
+	p.adapter.AddToolMessageFilter("Runtime.runScript", p.onRuntimeRunScript)
+	p.adapter.AddToolMessageFilter("Runtime.enable", p.onRuntimeEnable)
+	p.adapter.AddToolMessageFilter("Runtime.disable", p.onRuntimeDisable)
+	p.adapter.AddToolMessageFilter("Runtime.evaluate", p.onRuntimeEvaluate)
+	p.adapter.AddToolMessageFilter("Runtime.callFunctionOn", p.onCallFunctionOn)
+	p.adapter.AddToolMessageFilter("Runtime.awaitPromise", p.onAwaitPromise)
+	p.adapter.AddToolMessageFilter("Runtime.getProperties", p.onRuntimeGetProperties)
+	p.adapter.AddToolMessageFilter("Runtime.releaseObject", p.onReleaseObject)
+	p.adapter.AddToolMessageFilter("Runtime.globalLexicalScopeNames", p.onGlobalLexicalScopeNames)
+	p.adapter.AddToolMessageFilter("Runtime.queryObjects", p.onQueryObjects)
+	p.adapter.AddToolMessageFilter("Runtime.addBinding", p.onAddBinding)
+	p.adapter.AddToolMessageFilter("Runtime.removeBinding", p.onRemoveBinding)
 	p.adapter.AddWebkitMessageFilter("Runtime.executionContextCreated", p.onExecutionContextCreated)
-	p.adapter.AddWebkitMessageFilter("Runtime.evaluate", p.onEvaluate)
-	p.adapter.AddWebkitMessageFilter("Runtime.getProperties", p.onRuntimeGetProperties)
 	// Inspector
 	p.adapter.AddToolMessageFilter("Inspector.inspect", p.onInspect)
 }
@@ -169,11 +262,6 @@ func (p *protocolAdapter) onEmulationSetScriptExecutionDisabled(message []byte)
 	return ReplaceMethodNameAndOutputBinary(message, method)
 }
 
-func (p *protocolAdapter) onEmulationSetEmulatedMedia(message []byte) []byte {
-	method := "Page.setEmulatedMedia"
-	return ReplaceMethodNameAndOutputBinary(message, method)
-}
-
 func (p *protocolAdapter) onRenderingSetShowPaintRects(message []byte) []byte {
 	method := "Page.setShowPaintRects"
 	return ReplaceMethodNameAndOutputBinary(message, method)
@@ -184,15 +272,6 @@ func (p *protocolAdapter) onLogClear(message []byte) []byte {
 	return ReplaceMethodNameAndOutputBinary(message, method)
 }
 
-func (p *protocolAdapter) onLogDisable(message []byte) []byte {
-	method := "Console.disable"
-	return ReplaceMethodNameAndOutputBinary(message, method)
-}
-
-func (p *protocolAdapter) onLogEnable(message []byte) []byte {
-	method := "Console.enable"
-	return ReplaceMethodNameAndOutputBinary(message, method)
-}
 func (p *protocolAdapter) onNetworkGetCookies(message []byte) []byte {
 	method := "Page.getCookies"
 	return ReplaceMethodNameAndOutputBinary(message, method)
@@ -208,6 +287,37 @@ func (p *protocolAdapter) onNetworkSetMonitoringXHREnabled(message []byte) []byt
 	return ReplaceMethodNameAndOutputBinary(message, method)
 }
 
+func (p *protocolAdapter) onFrameNavigated(message []byte) []byte {
+	frame := gjson.Get(string(message), "params.frame")
+	if !frame.Exists() {
+		return message
+	}
+	isMainFrame := !frame.Get("parentId").Exists()
+	p.executionContexts.setOrigin(frame.Get("id").String(), frame.Get("securityOrigin").String())
+	p.executionContexts.setResourceFrame(frame.Get("url").String(), frame.Get("id").String())
+	if isMainFrame {
+		p.executionContexts.setMainFrame(frame.Get("id").String())
+		p.navigation.committed(frame.Get("id").String(), frame.Get("loaderId").String(), frame.Get("url").String())
+		p.navigationCommitted(frame.Get("loaderId").String())
+	}
+	p.lifecycle.frameNavigated(frame.Get("id").String(), frame.Get("loaderId").String(), isMainFrame)
+	return message
+}
+
+func (p *protocolAdapter) onDomContentEventFired(message []byte) []byte {
+	p.evaluateScriptOnLoad()
+	// with a bootstrap script the document already ran them before its own scripts
+	if !p.newDocumentScripts.native {
+		p.installRuntimeShim()
+		if p.emulation.active() {
+			p.applyEmulation(nil)
+		}
+		p.evaluateNewDocumentScripts()
+	}
+	p.lifecycle.domContentLoaded("", "")
+	return message
+}
+
 func (p *protocolAdapter) onGetMatchedStylesForNode(message []byte) []byte {
 	p.lastNodeId = gjson.Get(string(message), "params.nodeId").Int()
 	return message
@@ -266,124 +376,6 @@ func (p *protocolAdapter) onDebuggerEnable(message []byte) []byte {
 	return message
 }
 
-func (p *protocolAdapter) onExecutionContextCreated(message []byte) []byte {
-	msg := string(message)
-	var err error
-	if gjson.Get(msg, "params").Exists() && gjson.Get(msg, "params.context").Exists() {
-		if !gjson.Get(msg, "params.context.origin").Exists() {
-			msg, err = sjson.Set(msg, "params.context.origin", gjson.Get(msg, "params.context.name").String())
-			if err != nil {
-				log.Println(e.Convert(err).ToStr())
-			}
-			if gjson.Get(msg, "params.context.isPageContext").Exists() {
-				p.lastPageExecutionContextId = gjson.Get(msg, "params.context.id").Int()
-			}
-			if gjson.Get(msg, "params.context.frameId").Exists() {
-				msg, err = sjson.Set(msg, "params.context.auxData", map[string]interface{}{
-					"frameId":   gjson.Get(msg, "params.context.frameId").String(),
-					"isDefault": true,
-				})
-				if err != nil {
-					log.Println(e.Convert(err).ToStr())
-				}
-				if gjson.Get(msg, "params.context.frameId").Exists() {
-					msg, err = sjson.Delete(msg, "params.context.frameId")
-					if err != nil {
-						log.Println(e.Convert(err).ToStr())
-					}
-				}
-			}
-		}
-	}
-
-	return []byte(msg)
-}
-
-func (p *protocolAdapter) onEvaluate(message []byte) []byte {
-	msg := string(message)
-	var err error
-	result := gjson.Get(msg, "result")
-	if result.Exists() && result.Get("wasThrown").Exists() {
-		msg, err = sjson.Set(msg, "result.result.subtype", "error")
-		if err != nil {
-			return nil
-		}
-		msg, err = sjson.Set(msg, "result.exceptionDetails", map[string]interface{}{
-			"text":     gjson.Get(msg, "result.result.description").Value(),
-			"url":      "",
-			"scriptId": p.lastScriptEval,
-			"line":     1,
-			"column":   0,
-			"stack": map[string]interface{}{
-				"callFrames": []map[string]interface{}{
-					{
-						"functionName": "",
-						"scriptId":     p.lastScriptEval,
-						"url":          "",
-						"lineNumber":   1,
-						"columnNumber": 1,
-					},
-				},
-			},
-		})
-		if err != nil {
-			log.Println(e.Convert(err).ToStr())
-		}
-	} else if result.Exists() && result.Get("result").Exists() && result.Get("result.preview").Exists() {
-		msg, err = sjson.Set(msg, "result.result.preview.description", gjson.Get(msg, "result.result.description").Value())
-		if err != nil {
-			log.Println(e.Convert(err).ToStr())
-		}
-		msg, err = sjson.Set(msg, "result.result.preview.type", "object")
-		if err != nil {
-			log.Println(e.Convert(err).ToStr())
-		}
-	}
-	return []byte(msg)
-}
-
-func (p *protocolAdapter) onRuntimeOnCompileScript(message []byte) []byte {
-	params := map[string]interface{}{
-		"expression": gjson.Get(string(message), "params.expression").String(),
-		"contextId":  gjson.Get(string(message), "params.executionContextId").Int(),
-	}
-	p.adapter.CallTarget("Runtime.evaluate", params, func(msg []byte) {
-		result := map[string]interface{}{
-			"scriptId":         nil,
-			"exceptionDetails": nil,
-		}
-		p.adapter.FireResultToTools(int(gjson.Get(string(message), "id").Int()), result)
-	})
-	return nil
-}
-
-func (p *protocolAdapter) onRuntimeGetProperties(message []byte) []byte {
-	var newPropertyDescriptors []interface{}
-	var err error
-	msg := string(message)
-	for _, node := range gjson.Get(msg, "result.result").Array() {
-		isOwn := node.Get("isOwn")
-		nativeGetter := node.Get("nativeGetter")
-		if isOwn.Exists() || nativeGetter.Exists() {
-			msg, err = sjson.Set(msg, isOwn.Path(string(message)), true)
-			if err != nil {
-				log.Println(e.Convert(err).ToStr())
-			}
-			newPropertyDescriptors = append(newPropertyDescriptors, gjson.Get(msg, node.Path(msg)).Value())
-		}
-	}
-	msg, err = sjson.Set(msg, "result.result", newPropertyDescriptors)
-	if err != nil {
-		log.Println(e.Convert(err).ToStr())
-	}
-	return []byte(msg)
-}
-
-func (p *protocolAdapter) onScriptParsed(message []byte) []byte {
-	p.lastScriptEval = gjson.Get(string(message), "params.scriptId")
-	return message
-}
-
 func (p *protocolAdapter) onDomEnable(message []byte) []byte {
 	p.adapter.FireResultToTools(int(gjson.Get(string(message), "id").Int()), map[string]interface{}{})
 	return nil
@@ -531,23 +523,26 @@ func (p *protocolAdapter) onGetNodeForLocation(message []byte) []byte {
 	return nil
 }
 
-// todo screencast
 func (p *protocolAdapter) onStartScreencast(message []byte) []byte {
 	params := gjson.Get(string(message), "params")
-	format := params.Get("format").String()
-	quality := params.Get("quality").Int()
-	maxWidth := params.Get("maxWidth").Int()
-	maxHeight := params.Get("maxHeight").Int()
-	if p.screencast != nil {
-		// clear previous session
-		p.screencast.stop()
+	// only override the session defaults with what the tool passed
+	var options []ScreencastOptFunc
+	if params.Get("format").Exists() {
+		options = append(options, WithFormat(params.Get("format").String()))
+	}
+	if params.Get("quality").Exists() {
+		options = append(options, WithQuality(int(params.Get("quality").Int())))
+	}
+	if params.Get("maxWidth").Exists() {
+		options = append(options, WithMaxWidth(int(params.Get("maxWidth").Int())))
 	}
-	p.screencast = newScreencastSession(p.adapter,
-		WithFormat(format),
-		WithMaxWidth(int(maxWidth)),
-		WithMaxHeight(int(maxHeight)),
-		WithQuality(int(quality)))
-	p.screencast.start()
+	if params.Get("maxHeight").Exists() {
+		options = append(options, WithMaxHeight(int(params.Get("maxHeight").Int())))
+	}
+	if params.Get("everyNthFrame").Exists() {
+		options = append(options, WithEveryNthFrame(int(params.Get("everyNthFrame").Int())))
+	}
+	p.acquireScreencast().attachTool(options...)
 
 	p.adapter.FireResultToTools(int(gjson.Get(string(message), "id").Int()), map[string]interface{}{})
 
@@ -555,110 +550,62 @@ func (p *protocolAdapter) onStartScreencast(message []byte) []byte {
 }
 
 func (p *protocolAdapter) onStopScreencast(message []byte) []byte {
-	if p.screencast != nil {
-		// clear previous session
-		p.screencast.stop()
-		p.screencast = nil
-	}
+	p.releaseScreencast(func(screencast *screencastSession) {
+		screencast.detachTool()
+	})
 	p.adapter.FireResultToTools(int(gjson.Get(string(message), "id").Int()), map[string]interface{}{})
 
 	return nil
 }
 
+// acquireScreencast returns the running session, snapshots are shared by DevTools and the Go consumers
+func (p *protocolAdapter) acquireScreencast() *screencastSession {
+	p.screencastLock.Lock()
+	defer p.screencastLock.Unlock()
+	if p.screencast == nil {
+		p.screencast = newScreencastSession(p.adapter)
+		p.screencast.start()
+	}
+	return p.screencast
+}
+
+func (p *protocolAdapter) currentScreencast() *screencastSession {
+	p.screencastLock.Lock()
+	defer p.screencastLock.Unlock()
+	return p.screencast
+}
+
+// releaseScreencast detaches a consumer with release and stops the session once nobody is left
+func (p *protocolAdapter) releaseScreencast(release func(screencast *screencastSession)) {
+	p.screencastLock.Lock()
+	defer p.screencastLock.Unlock()
+	if p.screencast == nil {
+		return
+	}
+	release(p.screencast)
+	if p.screencast.idle() {
+		p.screencast.stop()
+		p.screencast = nil
+	}
+}
+
 func (p *protocolAdapter) onScreencastFrameAck(message []byte) []byte {
-	if p.screencast != nil {
+	if screencast := p.currentScreencast(); screencast != nil {
 		frameNumber := gjson.Get(string(message), "params.sessionId").Int()
 		// todo Change to int 64?
-		p.screencast.ackFrame(int(frameNumber))
+		screencast.ackFrame(int(frameNumber))
 	}
 	p.adapter.FireResultToTools(int(gjson.Get(string(message), "id").Int()), map[string]interface{}{})
 
 	return nil
 }
 
-func (p *protocolAdapter) onGetNavigationHistory(message []byte) []byte {
-	var href string
-	var id = int(gjson.Get(string(message), "id").Int())
-	p.adapter.CallTarget("Runtime.evaluate", map[string]interface{}{"expression": "window.location.href"}, func(result []byte) {
-		href = gjson.Get(string(result), "result.value").String()
-		p.adapter.CallTarget("Runtime.evaluate", map[string]interface{}{"expression": "window.title"}, func(msg []byte) {
-			title := gjson.Get(string(msg), "result.value").String()
-			p.adapter.FireResultToTools(id, map[string]interface{}{
-				"currentIndex": 0, "entries": []interface{}{
-					map[string]interface{}{
-						"id":    0,
-						"url":   href,
-						"title": title,
-					},
-				},
-			})
-		})
-	})
-	return nil
-}
-
-func (p *protocolAdapter) onEmulateTouchFromMouseEvent(message []byte) []byte {
-	var funcStr = `function simulate(params) {
-                const element = document.elementFromPoint(params.x, params.y);
-                const e = new MouseEvent(params.type, {
-                    screenX: params.x,
-                    screenY: params.y,
-                    clientX: 0,
-                    clientY: 0,
-                    ctrlKey: (params.modifiers & 2) === 2,
-                    shiftKey: (params.modifiers & 8) === 8,
-                    altKey: (params.modifiers & 1) === 1,
-                    metaKey: (params.modifiers & 4) === 4,
-                    button: params.button,
-                    bubbles: true,
-                    cancelable: false
-                });
-                element.dispatchEvent(e);
-                return element;
-            }`
-	newMsg := string(message)
-	oldMsg := string(message)
-	var err error
-	switch gjson.Get(newMsg, "params.type").String() {
-	case "mousePressed":
-		newMsg, err = sjson.Set(newMsg, "params.type", "mousedown")
-		if err != nil {
-			log.Println(e.Convert(err).ToStr())
-		}
-		break
-	case "mouseReleased":
-		newMsg, err = sjson.Set(newMsg, "params.type", "click")
-		if err != nil {
-			log.Println(e.Convert(err).ToStr())
-		}
-		break
-	case "mouseMoved":
-		newMsg, err = sjson.Set(newMsg, "params.type", "mousemove")
-		if err != nil {
-			log.Println(e.Convert(err).ToStr())
-		}
-		break
-	default:
-		log.Println(fmt.Sprintf("Unknown emulate mouse event name %s",
-			gjson.Get(oldMsg, "params.type")),
-		)
+// screencastViewport returns the geometry of the last screencast frame DevTools received
+func (p *protocolAdapter) screencastViewport() screencastViewport {
+	if screencast := p.currentScreencast(); screencast != nil {
+		return screencast.viewport()
 	}
-	var exp = fmt.Sprintf("(%s)(%s)", funcStr, newMsg)
-
-	p.adapter.CallTarget("Runtime.evaluate", map[string]interface{}{
-		"expression": exp,
-	}, func(result []byte) {
-		if gjson.Get(newMsg, "params.type").String() == "click" {
-			newMsg, err = sjson.Set(newMsg, "params.type", "mouseup")
-			if err != nil {
-				log.Println(e.Convert(err).ToStr())
-			}
-		}
-		p.adapter.CallTarget("Runtime.evaluate", map[string]interface{}{
-			"expression": exp,
-		}, nil)
-	})
-	return p.adapter.ReplyWithEmpty(newMsg)
+	return identityViewport
 }
 
 func (p *protocolAdapter) onCanEmulateNetworkConditions(message []byte) []byte {
@@ -669,44 +616,6 @@ func (p *protocolAdapter) onCanEmulateNetworkConditions(message []byte) []byte {
 	return nil
 }
 
-func (p *protocolAdapter) onConsoleMessageAdded(message []byte) []byte {
-	resultMessage := gjson.Get(string(message), "params.message")
-	messageType := resultMessage.Get("type").String()
-	var resultType string
-	if resultType == "log" {
-		switch messageType {
-		case "log":
-			resultType = "log"
-		case "info":
-			resultType = "info"
-		case "error":
-			resultType = "error"
-		default:
-			resultType = "log"
-		}
-	} else {
-		resultType = "log"
-	}
-	consoleMessage := map[string]interface{}{
-		"source":           gjson.Get(string(message), "source").Value(),
-		"level":            resultType,
-		"text":             gjson.Get(string(message), "text").Value(),
-		"lineNumber":       gjson.Get(string(message), "line").Value(),
-		"timestamp":        time.Now().UnixNano(),
-		"url":              gjson.Get(string(message), "url").Value(),
-		"networkRequestId": gjson.Get(string(message), "networkRequestId").Value(),
-	}
-	if gjson.Get(string(message), "stackTrace").Exists() {
-		consoleMessage["stackTrace"] = map[string]interface{}{
-			"callFrames": gjson.Get(string(message), "stackTrace").Value(),
-		}
-	} else {
-		consoleMessage["stackTrace"] = nil
-	}
-	p.adapter.FireEventToTools("Log.entryAdded", consoleMessage)
-	return nil
-}
-
 func (p *protocolAdapter) enumerateStyleSheets(message []byte) []byte {
 	p.adapter.CallTarget("CSS.getAllStyleSheets", map[string]interface{}{}, func(message []byte) {
 		newMsg := string(message)
@@ -0,0 +1,203 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"encoding/json"
+	"github.com/tidwall/gjson"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type runtimeBinding struct {
+	// installed in every new document, not only in one execution context
+	persistent bool
+	// executionContextName of Runtime.addBinding, the binding is only installed in the contexts with that name
+	contextName string
+}
+
+// runtimeBindings are the names given to Runtime.addBinding, runtimeShim installs them as global functions
+type runtimeBindings struct {
+	lock     sync.Mutex
+	bindings map[string]runtimeBinding
+}
+
+func newRuntimeBindings() *runtimeBindings {
+	return &runtimeBindings{
+		bindings: make(map[string]runtimeBinding),
+	}
+}
+
+func (b *runtimeBindings) add(name string, binding runtimeBinding) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if previous, ok := b.bindings[name]; ok && previous.persistent && previous.contextName == "" {
+		return
+	}
+	b.bindings[name] = binding
+}
+
+func (b *runtimeBindings) remove(name string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	_, ok := b.bindings[name]
+	delete(b.bindings, name)
+	return ok
+}
+
+func (b *runtimeBindings) has(name string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	_, ok := b.bindings[name]
+	return ok
+}
+
+// persistent returns the bindings of the bootstrap script, those of the page world of every document
+func (b *runtimeBindings) persistent() []string {
+	return b.names(runtimeBinding{persistent: true})
+}
+
+// named returns the bindings of the contexts called contextName
+func (b *runtimeBindings) named(contextName string) []string {
+	return b.names(runtimeBinding{persistent: true, contextName: contextName})
+}
+
+func (b *runtimeBindings) names(match runtimeBinding) []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var names []string
+	for name, binding := range b.bindings {
+		if binding == match {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// bindingScript installs names with the helper of runtimeShim, which has to run before
+func bindingScript(names []string) string {
+	var builder strings.Builder
+	for _, name := range names {
+		quotedName, _ := json.Marshal(name)
+		builder.WriteString("window.__sonicAddBinding(" + string(quotedName) + ");\n")
+	}
+	return builder.String()
+}
+
+// contextBindingScript installs names in the context contextId, their calls tell it
+func contextBindingScript(names []string, contextId int64) string {
+	var builder strings.Builder
+	for _, name := range names {
+		quotedName, _ := json.Marshal(name)
+		builder.WriteString("window.__sonicAddBinding(" + string(quotedName) + ", " + strconv.FormatInt(contextId, 10) + ");\n")
+	}
+	return builder.String()
+}
+
+// onBindingCalled sends what the page passed to a binding, nothing once the binding was removed. A binding installed
+// in one context passes its id, a binding of the bootstrap script passes the url of its document instead.
+func (p *protocolAdapter) onBindingCalled(name string, payload string, caller gjson.Result) {
+	if !p.bindings.has(name) {
+		return
+	}
+	contextId := p.lastPageExecutionContextId
+	if caller.Type == gjson.Number {
+		contextId = caller.Int()
+	} else if id, ok := p.executionContexts.defaultContextOf(caller.String(), ""); ok {
+		contextId = id
+	}
+	p.adapter.FireEventToTools("Runtime.bindingCalled", map[string]interface{}{
+		"name":               name,
+		"payload":            payload,
+		"executionContextId": contextId,
+	})
+}
+
+// installContextBindings installs the bindings of the contexts called name in a new context
+func (p *protocolAdapter) installContextBindings(contextId int64, name string) {
+	if name == "" {
+		return
+	}
+	names := p.bindings.named(name)
+	if len(names) == 0 {
+		return
+	}
+	p.adapter.CallTarget("Runtime.evaluate", map[string]interface{}{
+		"expression":                           p.pageChannel.shim() + contextBindingScript(names, contextId),
+		"contextId":                            contextId,
+		"doNotPauseOnExceptionsAndMuteConsole": true,
+	}, p.defaultCallFunc)
+}
+
+// onAddBinding installs the binding in the current document right away, and in every next one through the
+// bootstrap script unless it was only asked for one execution context. A binding for executionContextName is
+// installed in the contexts with that name, those of later documents included.
+func (p *protocolAdapter) onAddBinding(message []byte) []byte {
+	msg := string(message)
+	id := int(gjson.Get(msg, "id").Int())
+	params := gjson.Get(msg, "params")
+	name := params.Get("name").String()
+	if name == "" {
+		p.adapter.FireErrorToTools(id, serverErrorCode, "Binding name must not be empty")
+		return nil
+	}
+	if contextName := params.Get("executionContextName").String(); contextName != "" {
+		p.bindings.add(name, runtimeBinding{persistent: true, contextName: contextName})
+		for _, contextId := range p.executionContexts.named(contextName) {
+			p.adapter.CallTarget("Runtime.evaluate", map[string]interface{}{
+				"expression":                           p.pageChannel.shim() + contextBindingScript([]string{name}, contextId),
+				"contextId":                            contextId,
+				"doNotPauseOnExceptionsAndMuteConsole": true,
+			}, p.defaultCallFunc)
+		}
+		p.adapter.FireResultToTools(id, map[string]interface{}{})
+		return nil
+	}
+	contextId, hasContext := p.contextId(params, "executionContextId")
+	p.bindings.add(name, runtimeBinding{persistent: !hasContext})
+	evaluateParams := map[string]interface{}{
+		"expression":                           p.pageChannel.shim() + bindingScript([]string{name}),
+		"doNotPauseOnExceptionsAndMuteConsole": true,
+	}
+	if hasContext {
+		evaluateParams["expression"] = p.pageChannel.shim() + contextBindingScript([]string{name}, contextId)
+		evaluateParams["contextId"] = contextId
+	} else {
+		p.installBootstrapScript()
+	}
+	p.adapter.CallTarget("Runtime.evaluate", evaluateParams, func(result []byte) {
+		if isWebkitError(result) {
+			p.adapter.FireErrorToTools(id, serverErrorCode, gjson.GetBytes(result, "message").String())
+			return
+		}
+		p.adapter.FireResultToTools(id, map[string]interface{}{})
+	})
+	return nil
+}
+
+// onRemoveBinding stops the notifications, like in Chrome the function stays in the documents that have it
+func (p *protocolAdapter) onRemoveBinding(message []byte) []byte {
+	msg := string(message)
+	if p.bindings.remove(gjson.Get(msg, "params.name").String()) {
+		p.installBootstrapScript()
+	}
+	p.adapter.FireResultToTools(int(gjson.Get(msg, "id").Int()), map[string]interface{}{})
+	return nil
+}
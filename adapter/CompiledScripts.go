@@ -0,0 +1,202 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"encoding/json"
+	"github.com/tidwall/gjson"
+	"github.com/yezihack/e"
+	"log"
+	"strconv"
+	"sync"
+)
+
+// syntaxCheck parses source as the body of a function that is never called, an async one so that the
+// top level await of the console is valid. The line of the error is made relative to the source with a
+// probe, engines put their own header before the body. A content security policy forbidding eval leaves
+// the source unchecked.
+const syntaxCheck = `(function(source) {
+    let Compile = Function;
+    try {
+        Compile = Object.getPrototypeOf(async function() {}).constructor;
+    } catch (e) {
+    }
+    let firstLine = 1;
+    try {
+        new Compile('@');
+    } catch (e) {
+        if (typeof e.line === 'number') {
+            firstLine = e.line;
+        }
+    }
+    try {
+        new Compile(source);
+        return null;
+    } catch (e) {
+        if (!(e instanceof SyntaxError)) {
+            return null;
+        }
+        return {
+            message: String(e.message),
+            line: typeof e.line === 'number' ? e.line - firstLine : 0,
+            column: typeof e.column === 'number' ? e.column : 0
+        };
+    }
+})`
+
+type compiledScript struct {
+	expression string
+	sourceURL  string
+}
+
+// compiledScripts keeps the scripts compiled with persistScript until Runtime.runScript
+type compiledScripts struct {
+	lock    sync.Mutex
+	next    int
+	scripts map[string]compiledScript
+}
+
+func newCompiledScripts() *compiledScripts {
+	return &compiledScripts{
+		scripts: make(map[string]compiledScript),
+	}
+}
+
+func (c *compiledScripts) add(script compiledScript) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.next++
+	scriptId := "compiled" + strconv.Itoa(c.next)
+	c.scripts[scriptId] = script
+	return scriptId
+}
+
+func (c *compiledScripts) get(scriptId string) (compiledScript, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	script, ok := c.scripts[scriptId]
+	return script, ok
+}
+
+func (c *compiledScripts) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.scripts = make(map[string]compiledScript)
+}
+
+// withSourceURL names the script in stacks and in the sources panel
+func withSourceURL(expression string, sourceURL string) string {
+	if sourceURL == "" {
+		return expression
+	}
+	return expression + "\n//# sourceURL=" + sourceURL
+}
+
+// syntaxErrorDetails is the exceptionDetails of a syntax error found by syntaxCheck
+func (p *protocolAdapter) syntaxErrorDetails(syntaxError gjson.Result, sourceURL string) map[string]interface{} {
+	message := syntaxError.Get("message").String()
+	details := map[string]interface{}{
+		"exceptionId":  p.runtime.exceptionId(),
+		"text":         "Uncaught",
+		"lineNumber":   syntaxError.Get("line").Int(),
+		"columnNumber": zeroBased(int(syntaxError.Get("column").Int())),
+		"exception": map[string]interface{}{
+			"type":        "object",
+			"subtype":     "error",
+			"className":   "SyntaxError",
+			"description": "SyntaxError: " + message,
+		},
+	}
+	if sourceURL != "" {
+		details["url"] = sourceURL
+	}
+	return details
+}
+
+func (p *protocolAdapter) onRuntimeCompileScript(message []byte) []byte {
+	msg := string(message)
+	id := int(gjson.Get(msg, "id").Int())
+	params := gjson.Get(msg, "params")
+	expression := params.Get("expression").String()
+	sourceURL := params.Get("sourceURL").String()
+	quotedExpression, err := json.Marshal(expression)
+	if err != nil {
+		log.Println(e.Convert(err).ToStr())
+		p.adapter.FireErrorToTools(id, serverErrorCode, err.Error())
+		return nil
+	}
+	evaluateParams := map[string]interface{}{
+		"expression":                           syntaxCheck + "(" + string(quotedExpression) + ")",
+		"returnByValue":                        true,
+		"doNotPauseOnExceptionsAndMuteConsole": true,
+	}
+	if contextId, ok := p.contextId(params, "executionContextId"); ok {
+		evaluateParams["contextId"] = contextId
+	}
+	p.adapter.CallTarget("Runtime.evaluate", evaluateParams, func(result []byte) {
+		if isWebkitError(result) {
+			p.adapter.FireErrorToTools(id, serverErrorCode, gjson.GetBytes(result, "message").String())
+			return
+		}
+		if syntaxError := gjson.GetBytes(result, "result.value"); syntaxError.IsObject() {
+			p.adapter.FireResultToTools(id, map[string]interface{}{
+				"exceptionDetails": p.syntaxErrorDetails(syntaxError, sourceURL),
+			})
+			return
+		}
+		response := map[string]interface{}{}
+		if params.Get("persistScript").Bool() {
+			response["scriptId"] = p.compiledScripts.add(compiledScript{expression: expression, sourceURL: sourceURL})
+		}
+		p.adapter.FireResultToTools(id, response)
+	})
+	return nil
+}
+
+// onRuntimeRunScript evaluates a script kept by Runtime.compileScript like Runtime.evaluate would
+func (p *protocolAdapter) onRuntimeRunScript(message []byte) []byte {
+	msg := string(message)
+	id := gjson.Get(msg, "id").Int()
+	params := gjson.Get(msg, "params")
+	script, ok := p.compiledScripts.get(params.Get("scriptId").String())
+	if !ok {
+		p.adapter.FireErrorToTools(int(id), serverErrorCode, "No script with given id")
+		return nil
+	}
+	evaluateParams := map[string]interface{}{
+		"expression": withSourceURL(script.expression, script.sourceURL),
+	}
+	for _, key := range []string{"objectGroup", "silent", "includeCommandLineAPI", "returnByValue", "generatePreview", "awaitPromise"} {
+		if value := params.Get(key); value.Exists() {
+			evaluateParams[key] = value.Value()
+		}
+	}
+	if contextId := params.Get("executionContextId"); contextId.Exists() {
+		evaluateParams["contextId"] = contextId.Int()
+	}
+	evaluate, err := json.Marshal(map[string]interface{}{
+		"id":     id,
+		"method": "Runtime.evaluate",
+		"params": evaluateParams,
+	})
+	if err != nil {
+		log.Println(e.Convert(err).ToStr())
+		p.adapter.FireErrorToTools(int(id), serverErrorCode, err.Error())
+		return nil
+	}
+	return p.onRuntimeEvaluate(evaluate)
+}
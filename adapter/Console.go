@@ -0,0 +1,339 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"github.com/tidwall/gjson"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebKit logs an unhandled rejection as an error starting with this prefix
+const unhandledRejectionPrefix = "Unhandled Promise Rejection: "
+
+// Runtime.consoleAPICalled types by WebKit ConsoleMessage type, log takes the level instead
+var consoleAPITypes = map[string]string{
+	"dir":                 "dir",
+	"dirxml":              "dirxml",
+	"table":               "table",
+	"trace":               "trace",
+	"clear":               "clear",
+	"startGroup":          "startGroup",
+	"startGroupCollapsed": "startGroupCollapsed",
+	"endGroup":            "endGroup",
+	"assert":              "assert",
+	"timing":              "timeEnd",
+	"profile":             "profile",
+	"profileEnd":          "profileEnd",
+	"image":               "log",
+}
+
+var consoleLevelTypes = map[string]string{
+	"log":     "log",
+	"info":    "info",
+	"warning": "warning",
+	"error":   "error",
+	"debug":   "debug",
+}
+
+// Log.entryAdded sources by WebKit ConsoleMessage source, the others are reported as other
+var logEntrySources = map[string]string{
+	"xml":        "xml",
+	"javascript": "javascript",
+	"network":    "network",
+	"storage":    "storage",
+	"appcache":   "appcache",
+	"rendering":  "rendering",
+	"css":        "rendering",
+	"security":   "security",
+}
+
+var logEntryLevels = map[string]string{
+	"log":     "info",
+	"info":    "info",
+	"warning": "warning",
+	"error":   "error",
+	"debug":   "verbose",
+}
+
+// consoleMessages keeps the last event sent for a console message, WebKit only counts the repetitions of a message
+type consoleMessages struct {
+	lock       sync.Mutex
+	lastMethod string
+	lastParams map[string]interface{}
+	// the WebKit Console domain serves both, it stays enabled while one of them is
+	logEnabled     bool
+	runtimeEnabled bool
+}
+
+// setEnabled records whether the Log or the Runtime domain is enabled, it tells whether the Console domain was
+// enabled before and whether it still has to be
+func (c *consoleMessages) setEnabled(runtime bool, enabled bool) (wasEnabled bool, needed bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	wasEnabled = c.logEnabled || c.runtimeEnabled
+	if runtime {
+		c.runtimeEnabled = enabled
+	} else {
+		c.logEnabled = enabled
+	}
+	return wasEnabled, c.logEnabled || c.runtimeEnabled
+}
+
+func (c *consoleMessages) enabled() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.logEnabled || c.runtimeEnabled
+}
+
+// sends tells whether the tool enabled the domain of method
+func (c *consoleMessages) sends(method string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if strings.HasPrefix(method, "Log.") {
+		return c.logEnabled
+	}
+	return c.runtimeEnabled
+}
+
+func (c *consoleMessages) remember(method string, params map[string]interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lastMethod = method
+	c.lastParams = params
+}
+
+// forget follows a message the tool never saw, a repetition of it has nothing to send again
+func (c *consoleMessages) forget() {
+	c.remember("", nil)
+}
+
+func (c *consoleMessages) last() (string, map[string]interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lastMethod, c.lastParams
+}
+
+// mapConsoleStackTrace turns the stack of a ConsoleMessage, a list of frames on older WebKit, into a CDP StackTrace
+func mapConsoleStackTrace(stackTrace gjson.Result) map[string]interface{} {
+	frames := stackTrace
+	if !stackTrace.IsArray() {
+		frames = stackTrace.Get("callFrames")
+	}
+	callFrames := []map[string]interface{}{}
+	for _, frame := range frames.Array() {
+		callFrames = append(callFrames, map[string]interface{}{
+			"functionName": frame.Get("functionName").String(),
+			"scriptId":     frame.Get("scriptId").String(),
+			"url":          frame.Get("url").String(),
+			"lineNumber":   zeroBased(int(frame.Get("lineNumber").Int())),
+			"columnNumber": zeroBased(int(frame.Get("columnNumber").Int())),
+		})
+	}
+	if len(callFrames) == 0 {
+		return nil
+	}
+	return map[string]interface{}{"callFrames": callFrames}
+}
+
+// consoleTimestamp is the time of a ConsoleMessage in milliseconds, older WebKit does not send it
+func consoleTimestamp(message gjson.Result) float64 {
+	if timestamp := message.Get("timestamp"); timestamp.Exists() {
+		return timestamp.Float() * 1000
+	}
+	return float64(time.Now().UnixNano()) / float64(time.Millisecond)
+}
+
+func (p *protocolAdapter) consoleAPICalled(message gjson.Result) map[string]interface{} {
+	consoleType, ok := consoleAPITypes[message.Get("type").String()]
+	if !ok {
+		consoleType, ok = consoleLevelTypes[message.Get("level").String()]
+		if !ok {
+			consoleType = "log"
+		}
+	}
+	args := []map[string]interface{}{}
+	for _, parameter := range message.Get("parameters").Array() {
+		p.collectionEntries.observe(parameter)
+		args = append(args, mapRemoteObject(parameter))
+	}
+	if len(args) == 0 {
+		// console.time and friends only come with their formatted text
+		args = append(args, map[string]interface{}{
+			"type":  "string",
+			"value": message.Get("text").String(),
+		})
+	}
+	params := map[string]interface{}{
+		"type":               consoleType,
+		"args":               args,
+		"executionContextId": p.messageContextId(message),
+		"timestamp":          consoleTimestamp(message),
+	}
+	if stackTrace := mapConsoleStackTrace(message.Get("stackTrace")); stackTrace != nil {
+		params["stackTrace"] = stackTrace
+	}
+	return params
+}
+
+// exceptionThrown maps an uncaught exception or an unhandled rejection logged by WebKit
+func (p *protocolAdapter) exceptionThrown(message gjson.Result) map[string]interface{} {
+	exceptionId := p.runtime.exceptionId()
+	text := message.Get("text").String()
+	rejection := strings.HasPrefix(text, unhandledRejectionPrefix)
+	uncaught := "Uncaught"
+	if rejection {
+		uncaught = "Uncaught (in promise)"
+		text = strings.TrimPrefix(text, unhandledRejectionPrefix)
+		p.pageChannel.rejectionLogged(exceptionId)
+	}
+	details := map[string]interface{}{
+		"exceptionId":        exceptionId,
+		"text":               uncaught + " " + text,
+		"lineNumber":         zeroBased(int(message.Get("line").Int())),
+		"columnNumber":       zeroBased(int(message.Get("column").Int())),
+		"url":                message.Get("url").String(),
+		"executionContextId": p.messageContextId(message),
+	}
+	// recent WebKit passes the thrown value, DevTools then renders it instead of the text
+	if exception := message.Get("parameters.0"); exception.Exists() {
+		details["text"] = uncaught
+		details["exception"] = mapRemoteObject(exception)
+	}
+	if stackTrace := mapConsoleStackTrace(message.Get("stackTrace")); stackTrace != nil {
+		details["stackTrace"] = stackTrace
+	}
+	return map[string]interface{}{
+		"timestamp":        consoleTimestamp(message),
+		"exceptionDetails": details,
+	}
+}
+
+func logEntryAdded(message gjson.Result) map[string]interface{} {
+	source, ok := logEntrySources[message.Get("source").String()]
+	if !ok {
+		source = "other"
+	}
+	level, ok := logEntryLevels[message.Get("level").String()]
+	if !ok {
+		level = "info"
+	}
+	entry := map[string]interface{}{
+		"source":     source,
+		"level":      level,
+		"text":       message.Get("text").String(),
+		"timestamp":  consoleTimestamp(message),
+		"url":        message.Get("url").String(),
+		"lineNumber": zeroBased(int(message.Get("line").Int())),
+	}
+	if networkRequestId := message.Get("networkRequestId"); networkRequestId.Exists() {
+		entry["networkRequestId"] = networkRequestId.String()
+	}
+	if stackTrace := mapConsoleStackTrace(message.Get("stackTrace")); stackTrace != nil {
+		entry["stackTrace"] = stackTrace
+	}
+	return map[string]interface{}{"entry": entry}
+}
+
+// onConsoleMessageAdded sends what the page logged as Runtime.consoleAPICalled, its uncaught errors as
+// Runtime.exceptionThrown and what the browser logged as Log.entryAdded, each once its domain is enabled
+func (p *protocolAdapter) onConsoleMessageAdded(message []byte) []byte {
+	consoleMessage := gjson.GetBytes(message, "params.message")
+	source := consoleMessage.Get("source").String()
+	var method string
+	var params map[string]interface{}
+	switch {
+	case p.pageChannel.isMessage(consoleMessage):
+		p.console.forget()
+		p.onPageChannelMessage(consoleMessage)
+		return nil
+	case source == "console-api":
+		method = "Runtime.consoleAPICalled"
+		params = p.consoleAPICalled(consoleMessage)
+	case source == "javascript" && consoleMessage.Get("level").String() == "error":
+		method = "Runtime.exceptionThrown"
+		params = p.exceptionThrown(consoleMessage)
+	default:
+		method = "Log.entryAdded"
+		params = logEntryAdded(consoleMessage)
+	}
+	p.console.remember(method, params)
+	if p.console.sends(method) {
+		p.adapter.FireEventToTools(method, params)
+	}
+	return nil
+}
+
+// onConsoleMessageRepeatCountUpdated sends the last message again, DevTools groups the repetitions itself
+func (p *protocolAdapter) onConsoleMessageRepeatCountUpdated(message []byte) []byte {
+	method, params := p.console.last()
+	if params == nil || !p.console.sends(method) {
+		return nil
+	}
+	if method == "Runtime.exceptionThrown" {
+		params = p.repeatException(params)
+	}
+	p.adapter.FireEventToTools(method, params)
+	return nil
+}
+
+// repeatException gives a repeated exception an exceptionId of its own, a repeated rejection can be revoked on its own
+func (p *protocolAdapter) repeatException(params map[string]interface{}) map[string]interface{} {
+	previous, ok := params["exceptionDetails"].(map[string]interface{})
+	if !ok {
+		return params
+	}
+	details := make(map[string]interface{}, len(previous))
+	for key, value := range previous {
+		details[key] = value
+	}
+	details["exceptionId"] = p.runtime.exceptionId()
+	if text, _ := details["text"].(string); strings.HasPrefix(text, "Uncaught (in promise)") {
+		p.pageChannel.rejectionLogged(details["exceptionId"].(int))
+	}
+	return map[string]interface{}{
+		"timestamp":        float64(time.Now().UnixNano()) / float64(time.Millisecond),
+		"exceptionDetails": details,
+	}
+}
+
+// enableConsole turns the Console domain on for Log or Runtime
+func (p *protocolAdapter) enableConsole(runtime bool) {
+	if wasEnabled, _ := p.console.setEnabled(runtime, true); !wasEnabled {
+		p.adapter.CallTarget("Console.enable", map[string]interface{}{}, p.defaultCallFunc)
+	}
+}
+
+// disableConsole turns the Console domain off once neither Log nor Runtime needs it
+func (p *protocolAdapter) disableConsole(runtime bool) {
+	if wasEnabled, needed := p.console.setEnabled(runtime, false); wasEnabled && !needed {
+		p.adapter.CallTarget("Console.disable", map[string]interface{}{}, p.defaultCallFunc)
+	}
+}
+
+func (p *protocolAdapter) onLogEnable(message []byte) []byte {
+	p.enableConsole(false)
+	p.adapter.FireResultToTools(int(gjson.GetBytes(message, "id").Int()), map[string]interface{}{})
+	return nil
+}
+
+func (p *protocolAdapter) onLogDisable(message []byte) []byte {
+	p.disableConsole(false)
+	p.adapter.FireResultToTools(int(gjson.GetBytes(message, "id").Int()), map[string]interface{}{})
+	return nil
+}
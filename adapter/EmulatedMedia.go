@@ -0,0 +1,194 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"github.com/tidwall/gjson"
+	"strings"
+	"sync"
+)
+
+// WebKit user preferences overridable with Page.overrideUserPreference, by CDP media feature
+var userPreferenceFeatures = map[string]struct {
+	name   string
+	values map[string]string
+}{
+	"prefers-reduced-motion": {
+		name:   "PrefersReducedMotion",
+		values: map[string]string{"reduce": "Reduce", "no-preference": "NoPreference"},
+	},
+	"prefers-contrast": {
+		name:   "PrefersContrast",
+		values: map[string]string{"more": "More", "no-preference": "NoPreference"},
+	},
+}
+
+type targetCall struct {
+	method string
+	params map[string]interface{}
+}
+
+// emulatedMedia is the media state set by the tool, kept to install it again on a new target
+type emulatedMedia struct {
+	lock  sync.Mutex
+	media string
+	// prefers-color-scheme of Emulation.setEmulatedMedia, it wins over the auto dark mode
+	colorScheme string
+	// Emulation.setAutoDarkModeOverride, empty when not overridden
+	autoDarkMode string
+	// Page.overrideUserPreference values by preference name
+	preferences map[string]string
+	// a preference was overridden once, it has to be reset when cleared
+	preferencesTouched bool
+}
+
+func newEmulatedMedia() *emulatedMedia {
+	return &emulatedMedia{
+		preferences: make(map[string]string),
+	}
+}
+
+// active tells whether a new target needs the media state
+func (m *emulatedMedia) active() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.media != "" || m.colorScheme != "" || m.autoDarkMode != "" || len(m.preferences) > 0
+}
+
+// calls returns the WebKit commands setting the whole media state
+func (m *emulatedMedia) calls() []targetCall {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	calls := []targetCall{
+		{method: "Page.setEmulatedMedia", params: map[string]interface{}{"media": m.media}},
+	}
+	appearance := map[string]interface{}{}
+	colorScheme := m.colorScheme
+	if colorScheme == "" {
+		colorScheme = m.autoDarkMode
+	}
+	switch colorScheme {
+	case "dark":
+		appearance["appearance"] = "Dark"
+	case "light":
+		appearance["appearance"] = "Light"
+	}
+	// no appearance follows the system again
+	calls = append(calls, targetCall{method: "Page.setForcedAppearance", params: appearance})
+	for _, feature := range userPreferenceFeatures {
+		params := map[string]interface{}{"name": feature.name}
+		if value, ok := m.preferences[feature.name]; ok {
+			params["value"] = value
+		} else if !m.preferencesTouched {
+			// never overridden, no need to reset it
+			continue
+		}
+		calls = append(calls, targetCall{method: "Page.overrideUserPreference", params: params})
+	}
+	return calls
+}
+
+// applyEmulatedMedia sends the media state to WebKit one command after the other, then calls done
+func (p *protocolAdapter) applyEmulatedMedia(source string, done func()) {
+	calls := p.emulatedMedia.calls()
+	var next func(index int)
+	next = func(index int) {
+		if index == len(calls) {
+			if done != nil {
+				done()
+			}
+			return
+		}
+		call := calls[index]
+		p.adapter.CallTarget(call.method, call.params, func(result []byte) {
+			if isWebkitError(result) && source != "" {
+				p.warnTool(source + ": " + call.method + " is not supported by this iOS version, " + gjson.GetBytes(result, "message").String())
+			}
+			next(index + 1)
+		})
+	}
+	next(0)
+}
+
+func (p *protocolAdapter) onEmulationSetEmulatedMedia(message []byte) []byte {
+	msg := string(message)
+	id := int(gjson.Get(msg, "id").Int())
+	params := gjson.Get(msg, "params")
+
+	colorScheme := ""
+	preferences := make(map[string]string)
+	var unsupported []string
+	for _, feature := range params.Get("features").Array() {
+		name := feature.Get("name").String()
+		value := feature.Get("value").String()
+		if name == "prefers-color-scheme" {
+			if value == "dark" || value == "light" {
+				colorScheme = value
+			}
+			continue
+		}
+		preference, ok := userPreferenceFeatures[name]
+		if !ok {
+			unsupported = append(unsupported, name)
+			continue
+		}
+		// an empty value disables the override of the feature
+		if mapped, ok := preference.values[value]; ok {
+			preferences[preference.name] = mapped
+		}
+	}
+	if len(unsupported) > 0 {
+		p.warnTool("Emulation.setEmulatedMedia: " + strings.Join(unsupported, ", ") + " cannot be emulated on iOS")
+	}
+
+	p.emulatedMedia.lock.Lock()
+	p.emulatedMedia.media = params.Get("media").String()
+	p.emulatedMedia.colorScheme = colorScheme
+	p.emulatedMedia.preferences = preferences
+	if len(preferences) > 0 {
+		p.emulatedMedia.preferencesTouched = true
+	}
+	p.emulatedMedia.lock.Unlock()
+
+	source := "Emulation.setEmulatedMedia"
+	if len(preferences) == 0 && colorScheme == "" {
+		// only the media type changed, failures of the other commands are not worth a warning
+		source = ""
+	}
+	p.applyEmulatedMedia(source, func() {
+		p.adapter.FireResultToTools(id, map[string]interface{}{})
+	})
+	return nil
+}
+
+func (p *protocolAdapter) onSetAutoDarkModeOverride(message []byte) []byte {
+	msg := string(message)
+	id := int(gjson.Get(msg, "id").Int())
+	// disabled or absent both clear the override, the page follows the system appearance again
+	autoDarkMode := ""
+	if gjson.Get(msg, "params.enabled").Bool() {
+		autoDarkMode = "dark"
+		p.warnTool("Emulation.setAutoDarkModeOverride: WebKit does not darken pages, the dark appearance only applies to pages with dark styles")
+	}
+	p.emulatedMedia.lock.Lock()
+	p.emulatedMedia.autoDarkMode = autoDarkMode
+	p.emulatedMedia.lock.Unlock()
+	p.applyEmulatedMedia("Emulation.setAutoDarkModeOverride", func() {
+		p.adapter.FireResultToTools(id, map[string]interface{}{})
+	})
+	return nil
+}
@@ -0,0 +1,396 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"github.com/yezihack/e"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// emulationShim applies the overrides WebKit has no command for, it is idempotent and undoes what state no longer holds
+const emulationShim = "function applyEmulation(state) {" +
+	viewportShim +
+	navigatorShim +
+	geolocationShim +
+	intlShim +
+	orientationShim +
+	"    return true;\n}"
+
+// emulationOverrides are the values set by the tool, fields are replaced and never modified in place
+type emulationOverrides struct {
+	// content of the viewport meta tag, empty when metrics are not overridden
+	viewport string
+	// user agent applied with the JS fallback, empty when not overridden
+	userAgent string
+	platform  string
+	// latitude, longitude and accuracy, or unavailable
+	geolocation map[string]interface{}
+	timezone    string
+	locale      string
+	// alpha, beta and gamma
+	orientation map[string]interface{}
+}
+
+// deviceEmulation holds the Emulation overrides of the tool, they are applied again on every document
+type deviceEmulation struct {
+	lock sync.Mutex
+	// WebKit commands available on this iOS version, set by initProtocolAdapter
+	nativeUserAgent  bool
+	nativeScreenSize bool
+	overrides        emulationOverrides
+}
+
+func newDeviceEmulation() *deviceEmulation {
+	return &deviceEmulation{}
+}
+
+// active tells whether a new document needs emulationShim
+func (d *deviceEmulation) active() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	o := d.overrides
+	return o.viewport != "" || o.userAgent != "" || o.platform != "" || o.geolocation != nil ||
+		o.timezone != "" || o.locale != "" || o.orientation != nil
+}
+
+// update changes the overrides with change and returns the previous ones
+func (d *deviceEmulation) update(change func(overrides *emulationOverrides)) emulationOverrides {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	previous := d.overrides
+	change(&d.overrides)
+	return previous
+}
+
+// state is the argument of emulationShim
+func (d *deviceEmulation) state() map[string]interface{} {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	o := d.overrides
+	navigatorOverrides := map[string]interface{}{}
+	if o.userAgent != "" {
+		navigatorOverrides["userAgent"] = o.userAgent
+		navigatorOverrides["appVersion"] = strings.TrimPrefix(o.userAgent, "Mozilla/")
+	}
+	if o.platform != "" {
+		navigatorOverrides["platform"] = o.platform
+	}
+	if o.locale != "" {
+		navigatorOverrides["language"] = o.locale
+		navigatorOverrides["languages"] = []string{o.locale}
+	}
+	state := map[string]interface{}{
+		"navigator": navigatorOverrides,
+	}
+	if o.viewport != "" {
+		state["viewport"] = o.viewport
+	}
+	if o.geolocation != nil {
+		state["geolocation"] = o.geolocation
+	}
+	if o.timezone != "" {
+		state["timezone"] = o.timezone
+	}
+	if o.locale != "" {
+		state["locale"] = o.locale
+	}
+	if o.orientation != nil {
+		state["orientation"] = o.orientation
+	}
+	return state
+}
+
+// updateEmulation changes the overrides of the next documents and returns the previous ones
+func (p *protocolAdapter) updateEmulation(change func(overrides *emulationOverrides)) emulationOverrides {
+	previous := p.emulation.update(change)
+	p.installBootstrapScript()
+	return previous
+}
+
+// applyEmulation runs emulationShim with the current overrides in the page
+func (p *protocolAdapter) applyEmulation(callFunc func(message []byte)) {
+	arguments, err := json.Marshal(p.emulation.state())
+	if err != nil {
+		log.Println(e.Convert(err).ToStr())
+		return
+	}
+	if callFunc == nil {
+		callFunc = p.defaultCallFunc
+	}
+	p.adapter.CallTarget("Runtime.evaluate", map[string]interface{}{
+		"expression": fmt.Sprintf("(%s)(%s)", emulationShim, arguments),
+	}, callFunc)
+}
+
+// warnTool shows in the DevTools console what an emulation command could not do
+func (p *protocolAdapter) warnTool(text string) {
+	log.Println(text)
+	p.adapter.FireEventToTools("Log.entryAdded", map[string]interface{}{
+		"entry": map[string]interface{}{
+			"source":    "other",
+			"level":     "warning",
+			"text":      text,
+			"timestamp": float64(time.Now().UnixNano()) / float64(time.Millisecond),
+		},
+	})
+}
+
+// isWebkitError tells whether a CallTarget callback received an error instead of a result
+func isWebkitError(message []byte) bool {
+	return gjson.GetBytes(message, "code").Exists() && gjson.GetBytes(message, "message").Exists()
+}
+
+func (p *protocolAdapter) onSetDeviceMetricsOverride(message []byte) []byte {
+	msg := string(message)
+	id := int(gjson.Get(msg, "id").Int())
+	params := gjson.Get(msg, "params")
+	width := params.Get("width").Int()
+	height := params.Get("height").Int()
+	scale := params.Get("scale").Float()
+
+	// 0 disables the override of a value, the page keeps its own viewport when both are 0
+	var viewport []string
+	if width > 0 || scale > 0 {
+		if width > 0 {
+			viewport = append(viewport, fmt.Sprintf("width=%d", width))
+		} else {
+			viewport = append(viewport, "width=device-width")
+		}
+		if scale > 0 {
+			viewport = append(viewport, fmt.Sprintf("initial-scale=%g", scale))
+		} else {
+			viewport = append(viewport, "initial-scale=1")
+		}
+	}
+
+	var unapplied []string
+	if height > 0 {
+		unapplied = append(unapplied, "height")
+	}
+	if params.Get("deviceScaleFactor").Float() > 0 {
+		unapplied = append(unapplied, "deviceScaleFactor")
+	}
+	if params.Get("mobile").Exists() && !params.Get("mobile").Bool() {
+		unapplied = append(unapplied, "mobile")
+	}
+	if params.Get("positionX").Int() != 0 || params.Get("positionY").Int() != 0 {
+		unapplied = append(unapplied, "positionX/positionY")
+	}
+	for _, name := range []string{"screenOrientation", "viewport", "displayFeature"} {
+		if params.Get(name).Exists() {
+			unapplied = append(unapplied, name)
+		}
+	}
+
+	screenWidth := params.Get("screenWidth").Int()
+	screenHeight := params.Get("screenHeight").Int()
+	if screenWidth == 0 {
+		screenWidth = width
+	}
+	if screenHeight == 0 {
+		screenHeight = height
+	}
+
+	p.updateEmulation(func(overrides *emulationOverrides) {
+		overrides.viewport = strings.Join(viewport, ", ")
+	})
+	nativeScreenSize := p.emulation.nativeScreenSize
+
+	// Page.setScreenSizeOverride takes both dimensions, without it the screen keeps the size of the device
+	if screenWidth > 0 || screenHeight > 0 {
+		if nativeScreenSize && screenWidth > 0 && screenHeight > 0 {
+			p.adapter.CallTarget("Page.setScreenSizeOverride", map[string]interface{}{
+				"width":  screenWidth,
+				"height": screenHeight,
+			}, func(result []byte) {
+				if isWebkitError(result) {
+					p.warnTool("Emulation.setDeviceMetricsOverride: the screen size cannot be overridden, " + gjson.GetBytes(result, "message").String())
+				}
+			})
+		} else {
+			unapplied = append(unapplied, "screenWidth/screenHeight")
+		}
+	}
+	if len(unapplied) > 0 {
+		p.warnTool("Emulation.setDeviceMetricsOverride: " + strings.Join(unapplied, ", ") + " cannot be applied on iOS, only the layout width and scale are emulated")
+	}
+	p.applyEmulation(func(result []byte) {
+		p.adapter.FireResultToTools(id, map[string]interface{}{})
+	})
+	return nil
+}
+
+func (p *protocolAdapter) onClearDeviceMetricsOverride(message []byte) []byte {
+	id := int(gjson.Get(string(message), "id").Int())
+	p.updateEmulation(func(overrides *emulationOverrides) {
+		overrides.viewport = ""
+	})
+	if p.emulation.nativeScreenSize {
+		p.adapter.CallTarget("Page.setScreenSizeOverride", map[string]interface{}{}, p.defaultCallFunc)
+	}
+	p.applyEmulation(func(result []byte) {
+		p.adapter.FireResultToTools(id, map[string]interface{}{})
+	})
+	return nil
+}
+
+// onSetUserAgentOverride handles both Emulation.setUserAgentOverride and Network.setUserAgentOverride
+func (p *protocolAdapter) onSetUserAgentOverride(message []byte) []byte {
+	msg := string(message)
+	id := int(gjson.Get(msg, "id").Int())
+	params := gjson.Get(msg, "params")
+	method := gjson.Get(msg, "method").String()
+	userAgent := params.Get("userAgent").String()
+
+	var unapplied []string
+	for _, name := range []string{"acceptLanguage", "userAgentMetadata"} {
+		if params.Get(name).Exists() && params.Get(name).String() != "" {
+			unapplied = append(unapplied, name)
+		}
+	}
+	if len(unapplied) > 0 {
+		p.warnTool(method + ": " + strings.Join(unapplied, ", ") + " cannot be applied on iOS")
+	}
+
+	// the bootstrap script is installed once, with the user agent of the branch taken below
+	p.emulation.update(func(overrides *emulationOverrides) {
+		overrides.platform = params.Get("platform").String()
+	})
+
+	useFallback := func() {
+		p.updateEmulation(func(overrides *emulationOverrides) {
+			overrides.userAgent = userAgent
+		})
+		if userAgent != "" {
+			p.warnTool(method + ": only navigator.userAgent is overridden, requests keep the User-Agent header of the WebView")
+		}
+		p.applyEmulation(func(result []byte) {
+			p.adapter.FireResultToTools(id, map[string]interface{}{})
+		})
+	}
+	if !p.emulation.nativeUserAgent {
+		useFallback()
+		return nil
+	}
+	// an empty value restores the default user agent
+	p.adapter.CallTarget("Page.overrideUserAgent", map[string]interface{}{
+		"value": userAgent,
+	}, func(result []byte) {
+		if isWebkitError(result) {
+			useFallback()
+			return
+		}
+		p.updateEmulation(func(overrides *emulationOverrides) {
+			overrides.userAgent = ""
+		})
+		p.applyEmulation(func(result []byte) {
+			p.adapter.FireResultToTools(id, map[string]interface{}{})
+		})
+	})
+	return nil
+}
+
+// setEmulation changes the overrides and applies them, a shim throwing restores the previous overrides
+// and answers errorMessage to the tool
+func (p *protocolAdapter) setEmulation(id int, errorMessage string, change func(overrides *emulationOverrides)) {
+	previous := p.updateEmulation(change)
+	p.applyEmulation(func(result []byte) {
+		if gjson.GetBytes(result, "wasThrown").Bool() || isWebkitError(result) {
+			p.updateEmulation(func(overrides *emulationOverrides) {
+				*overrides = previous
+			})
+			p.applyEmulation(nil)
+			p.adapter.FireErrorToTools(id, serverErrorCode, errorMessage)
+			return
+		}
+		p.adapter.FireResultToTools(id, map[string]interface{}{})
+	})
+}
+
+func (p *protocolAdapter) onSetGeolocationOverride(message []byte) []byte {
+	msg := string(message)
+	params := gjson.Get(msg, "params")
+	// omitting any of the values emulates position unavailable
+	geolocation := map[string]interface{}{
+		"unavailable": true,
+	}
+	if params.Get("latitude").Exists() && params.Get("longitude").Exists() && params.Get("accuracy").Exists() {
+		geolocation = map[string]interface{}{
+			"latitude":  params.Get("latitude").Float(),
+			"longitude": params.Get("longitude").Float(),
+			"accuracy":  params.Get("accuracy").Float(),
+		}
+	}
+	p.setEmulation(int(gjson.Get(msg, "id").Int()), "Unable to override the geolocation", func(overrides *emulationOverrides) {
+		overrides.geolocation = geolocation
+	})
+	return nil
+}
+
+func (p *protocolAdapter) onClearGeolocationOverride(message []byte) []byte {
+	p.setEmulation(int(gjson.Get(string(message), "id").Int()), "Unable to clear the geolocation override", func(overrides *emulationOverrides) {
+		overrides.geolocation = nil
+	})
+	return nil
+}
+
+func (p *protocolAdapter) onSetTimezoneOverride(message []byte) []byte {
+	msg := string(message)
+	timezoneID := gjson.Get(msg, "params.timezoneId").String()
+	// an empty id restores the timezone of the device
+	p.setEmulation(int(gjson.Get(msg, "id").Int()), "Invalid timezone ID: "+timezoneID, func(overrides *emulationOverrides) {
+		overrides.timezone = timezoneID
+	})
+	return nil
+}
+
+func (p *protocolAdapter) onSetLocaleOverride(message []byte) []byte {
+	msg := string(message)
+	locale := gjson.Get(msg, "params.locale").String()
+	// no locale restores the locale of the device
+	p.setEmulation(int(gjson.Get(msg, "id").Int()), "Invalid locale name: "+locale, func(overrides *emulationOverrides) {
+		overrides.locale = locale
+	})
+	return nil
+}
+
+func (p *protocolAdapter) onSetDeviceOrientationOverride(message []byte) []byte {
+	msg := string(message)
+	params := gjson.Get(msg, "params")
+	orientation := map[string]interface{}{
+		"alpha": params.Get("alpha").Float(),
+		"beta":  params.Get("beta").Float(),
+		"gamma": params.Get("gamma").Float(),
+	}
+	p.setEmulation(int(gjson.Get(msg, "id").Int()), "Unable to override the device orientation", func(overrides *emulationOverrides) {
+		overrides.orientation = orientation
+	})
+	return nil
+}
+
+func (p *protocolAdapter) onClearDeviceOrientationOverride(message []byte) []byte {
+	p.setEmulation(int(gjson.Get(string(message), "id").Int()), "Unable to clear the device orientation override", func(overrides *emulationOverrides) {
+		overrides.orientation = nil
+	})
+	return nil
+}
@@ -0,0 +1,307 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+// Parts of emulationShim, each one reads its field of state and undoes its override when the field is missing.
+// They run in the body of applyEmulation(state).
+
+// viewportShim emulates the layout viewport with the viewport meta tag, the only knob a page has on iOS:
+// the original tag is kept in data-sonic-original and restored once the override is cleared.
+// While the document loads it waits for the tags of the page, the last viewport tag parsed wins.
+const viewportShim = `
+    const applyViewport = () => {
+        let meta = document.querySelector('meta[name="viewport"]');
+        if (state.viewport) {
+            if (!meta) {
+                meta = document.createElement('meta');
+                meta.setAttribute('name', 'viewport');
+                meta.setAttribute('data-sonic-created', '');
+                (document.head || document.documentElement).appendChild(meta);
+            } else if (!meta.hasAttribute('data-sonic-original') && !meta.hasAttribute('data-sonic-created')) {
+                meta.setAttribute('data-sonic-original', meta.getAttribute('content') || '');
+            }
+            meta.setAttribute('content', state.viewport);
+        } else if (meta) {
+            if (meta.hasAttribute('data-sonic-created')) {
+                meta.remove();
+            } else if (meta.hasAttribute('data-sonic-original')) {
+                meta.setAttribute('content', meta.getAttribute('data-sonic-original'));
+                meta.removeAttribute('data-sonic-original');
+            }
+        }
+    };
+    if (document.readyState !== 'loading') {
+        applyViewport();
+    } else {
+        document.addEventListener('DOMContentLoaded', applyViewport, {once: true});
+    }
+`
+
+// navigatorShim shadows navigator properties on the instance, deleting them reveals the native getters again
+const navigatorShim = `
+    const navigatorOverrides = state.navigator || {};
+    for (const name of ['userAgent', 'appVersion', 'platform', 'language', 'languages']) {
+        if (navigatorOverrides[name] !== undefined) {
+            const value = navigatorOverrides[name];
+            Object.defineProperty(navigator, name, {get: () => value, configurable: true});
+        } else if (Object.prototype.hasOwnProperty.call(navigator, name)) {
+            delete navigator[name];
+        }
+    }
+`
+
+// geolocationShim answers navigator.geolocation from state.geolocation, watchers are notified of every new position
+const geolocationShim = `
+    const geolocation = navigator.geolocation;
+    if (geolocation) {
+        const watchers = window.__sonicGeolocationWatchers || (window.__sonicGeolocationWatchers = {next: 1, callbacks: {}});
+        const position = state.geolocation;
+        if (position) {
+            const report = (success, error) => {
+                setTimeout(() => {
+                    if (position.unavailable) {
+                        if (error) {
+                            error({code: 2, message: 'Position unavailable', PERMISSION_DENIED: 1, POSITION_UNAVAILABLE: 2, TIMEOUT: 3});
+                        }
+                        return;
+                    }
+                    success({
+                        coords: {
+                            latitude: position.latitude, longitude: position.longitude, accuracy: position.accuracy,
+                            altitude: null, altitudeAccuracy: null, heading: null, speed: null
+                        },
+                        timestamp: Date.now()
+                    });
+                }, 0);
+            };
+            geolocation.getCurrentPosition = (success, error) => report(success, error);
+            geolocation.watchPosition = (success, error) => {
+                const id = watchers.next++;
+                watchers.callbacks[id] = {success: success, error: error};
+                report(success, error);
+                return id;
+            };
+            geolocation.clearWatch = (id) => {
+                delete watchers.callbacks[id];
+            };
+            for (const id in watchers.callbacks) {
+                report(watchers.callbacks[id].success, watchers.callbacks[id].error);
+            }
+        } else {
+            for (const name of ['getCurrentPosition', 'watchPosition', 'clearWatch']) {
+                if (Object.prototype.hasOwnProperty.call(geolocation, name)) {
+                    delete geolocation[name];
+                }
+            }
+            watchers.callbacks = {};
+        }
+    }
+`
+
+// intlShim applies state.locale and state.timezone to Intl, the toLocale methods and the local time of Date.
+// The natives are saved once per document in __sonicOriginals and put back before every application.
+// Strings without offset given to Date.parse or new Date keep being read in the device timezone.
+const intlShim = `
+    const original = window.__sonicOriginals || (window.__sonicOriginals = (() => {
+        const saved = {Date: window.Date, intl: {}, date: {}, numberToLocaleString: Number.prototype.toLocaleString,
+            localeCompare: String.prototype.localeCompare};
+        for (const name of ['DateTimeFormat', 'NumberFormat', 'Collator', 'PluralRules', 'RelativeTimeFormat', 'ListFormat']) {
+            if (Intl[name]) {
+                saved.intl[name] = Intl[name];
+            }
+        }
+        for (const name of Object.getOwnPropertyNames(window.Date.prototype)) {
+            saved.date[name] = window.Date.prototype[name];
+        }
+        return saved;
+    })());
+    const NativeDate = original.Date;
+    window.Date = NativeDate;
+    for (const name in original.intl) {
+        Intl[name] = original.intl[name];
+    }
+    for (const name in original.date) {
+        NativeDate.prototype[name] = original.date[name];
+    }
+    Number.prototype.toLocaleString = original.numberToLocaleString;
+    String.prototype.localeCompare = original.localeCompare;
+
+    const locale = state.locale || undefined;
+    const timeZone = state.timezone || undefined;
+    if (locale || timeZone) {
+        // throws a RangeError on an unknown locale or timezone before anything is replaced
+        new original.intl.DateTimeFormat(locale, {timeZone: timeZone});
+        const withZone = (options) => timeZone && (!options || options.timeZone === undefined) ?
+            Object.assign({}, options, {timeZone: timeZone}) : options;
+        for (const name in original.intl) {
+            const Native = original.intl[name];
+            const zoned = name === 'DateTimeFormat';
+            const Wrapped = function(locales, options) {
+                return new Native(locales === undefined ? locale : locales, zoned ? withZone(options) : options);
+            };
+            Wrapped.prototype = Native.prototype;
+            Wrapped.supportedLocalesOf = Native.supportedLocalesOf;
+            Intl[name] = Wrapped;
+        }
+        for (const name of ['toLocaleString', 'toLocaleDateString', 'toLocaleTimeString']) {
+            const native = original.date[name];
+            NativeDate.prototype[name] = function(locales, options) {
+                return native.call(this, locales === undefined ? locale : locales, withZone(options));
+            };
+        }
+        if (locale) {
+            Number.prototype.toLocaleString = function(locales, options) {
+                return original.numberToLocaleString.call(this, locales === undefined ? locale : locales, options);
+            };
+            String.prototype.localeCompare = function(that, locales, options) {
+                return original.localeCompare.call(this, that, locales === undefined ? locale : locales, options);
+            };
+        }
+    }
+    if (timeZone) {
+        const getTime = original.date.getTime;
+        const partsFormat = new original.intl.DateTimeFormat('en-US', {timeZone: timeZone, hourCycle: 'h23',
+            year: 'numeric', month: 'numeric', day: 'numeric', hour: 'numeric', minute: 'numeric', second: 'numeric'});
+        const nameFormat = new original.intl.DateTimeFormat('en-US', {timeZone: timeZone, timeZoneName: 'long'});
+        // minutes to add to UTC to get the local time of the zone at time
+        const zoneOffset = (time) => {
+            const parts = {};
+            for (const part of partsFormat.formatToParts(new NativeDate(time))) {
+                parts[part.type] = part.value;
+            }
+            const seconds = Math.floor(time / 1000) * 1000;
+            const local = NativeDate.UTC(+parts.year, +parts.month - 1, +parts.day, +parts.hour % 24, +parts.minute, +parts.second);
+            return Math.round((local - seconds) / 60000);
+        };
+        // local time of the zone, as a date whose UTC fields are the local fields
+        const shifted = (date) => {
+            const time = getTime.call(date);
+            return new NativeDate(isNaN(time) ? NaN : time + zoneOffset(time) * 60000);
+        };
+        const fromLocal = (local) => {
+            const guess = local - zoneOffset(local) * 60000;
+            return local - zoneOffset(guess) * 60000;
+        };
+        const fields = ['FullYear', 'Month', 'Date', 'Day', 'Hours', 'Minutes', 'Seconds', 'Milliseconds'];
+        for (const field of fields) {
+            const getUTC = original.date['getUTC' + field];
+            NativeDate.prototype['get' + field] = function() {
+                return getUTC.call(shifted(this));
+            };
+            if (field === 'Day') {
+                continue;
+            }
+            const setUTC = original.date['setUTC' + field];
+            NativeDate.prototype['set' + field] = function() {
+                const local = shifted(this);
+                setUTC.apply(local, arguments);
+                return original.date.setTime.call(this, fromLocal(getTime.call(local)));
+            };
+        }
+        NativeDate.prototype.getTimezoneOffset = function() {
+            const time = getTime.call(this);
+            return isNaN(time) ? NaN : -zoneOffset(time);
+        };
+        const pad = (value) => String(value).padStart(2, '0');
+        const days = ['Sun', 'Mon', 'Tue', 'Wed', 'Thu', 'Fri', 'Sat'];
+        const months = ['Jan', 'Feb', 'Mar', 'Apr', 'May', 'Jun', 'Jul', 'Aug', 'Sep', 'Oct', 'Nov', 'Dec'];
+        const dateText = (local) => days[local.getUTCDay()] + ' ' + months[local.getUTCMonth()] + ' ' +
+            pad(local.getUTCDate()) + ' ' + String(local.getUTCFullYear()).padStart(4, '0');
+        const timeText = (date, local) => {
+            const offset = zoneOffset(getTime.call(date));
+            const zoneName = (nameFormat.formatToParts(date).find((part) => part.type === 'timeZoneName') || {}).value || timeZone;
+            return pad(local.getUTCHours()) + ':' + pad(local.getUTCMinutes()) + ':' + pad(local.getUTCSeconds()) +
+                ' GMT' + (offset < 0 ? '-' : '+') + pad(Math.floor(Math.abs(offset) / 60)) + pad(Math.abs(offset) % 60) +
+                ' (' + zoneName + ')';
+        };
+        NativeDate.prototype.toString = function() {
+            const local = shifted(this);
+            return isNaN(getTime.call(local)) ? 'Invalid Date' : dateText(local) + ' ' + timeText(this, local);
+        };
+        NativeDate.prototype.toDateString = function() {
+            const local = shifted(this);
+            return isNaN(getTime.call(local)) ? 'Invalid Date' : dateText(local);
+        };
+        NativeDate.prototype.toTimeString = function() {
+            const local = shifted(this);
+            return isNaN(getTime.call(local)) ? 'Invalid Date' : timeText(this, local);
+        };
+        // the constructor reads its fields as local time of the zone
+        const ZonedDate = function() {
+            if (!new.target) {
+                return new ZonedDate().toString();
+            }
+            let date;
+            if (arguments.length >= 2) {
+                date = new NativeDate(fromLocal(NativeDate.UTC.apply(null, arguments)));
+            } else {
+                date = new NativeDate(...arguments);
+            }
+            Object.setPrototypeOf(date, new.target.prototype);
+            return date;
+        };
+        ZonedDate.prototype = NativeDate.prototype;
+        ZonedDate.UTC = NativeDate.UTC;
+        ZonedDate.now = NativeDate.now;
+        ZonedDate.parse = NativeDate.parse;
+        window.Date = ZonedDate;
+    }
+`
+
+// orientationShim fires state.orientation as deviceorientation events and hides the sensor events meanwhile
+const orientationShim = `
+    if (window.__sonicOrientationTimer) {
+        clearInterval(window.__sonicOrientationTimer);
+        window.__sonicOrientationTimer = 0;
+    }
+    if (!window.__sonicOrientationFilter) {
+        window.__sonicOrientationFilter = true;
+        window.addEventListener('deviceorientation', (event) => {
+            if (event.isTrusted && window.__sonicOrientation) {
+                event.stopImmediatePropagation();
+            }
+        }, true);
+    }
+    window.__sonicOrientation = state.orientation || null;
+    const OrientationEvent = window.DeviceOrientationEvent;
+    if (state.orientation) {
+        if (OrientationEvent && OrientationEvent.requestPermission && !window.__sonicOrientationPermission) {
+            window.__sonicOrientationPermission = OrientationEvent.requestPermission;
+            OrientationEvent.requestPermission = () => Promise.resolve('granted');
+        }
+        const fire = () => {
+            const orientation = window.__sonicOrientation;
+            if (!orientation) {
+                return;
+            }
+            const init = {alpha: orientation.alpha, beta: orientation.beta, gamma: orientation.gamma, absolute: false};
+            let event;
+            try {
+                event = new OrientationEvent('deviceorientation', init);
+            } catch (e) {
+                event = new Event('deviceorientation');
+                Object.assign(event, init);
+            }
+            window.dispatchEvent(event);
+        };
+        fire();
+        window.__sonicOrientationTimer = setInterval(fire, 200);
+    } else if (window.__sonicOrientationPermission) {
+        OrientationEvent.requestPermission = window.__sonicOrientationPermission;
+        window.__sonicOrientationPermission = null;
+    }
+`
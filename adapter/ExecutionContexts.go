@@ -0,0 +1,324 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"github.com/tidwall/gjson"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type executionContext struct {
+	id       int64
+	uniqueId string
+	frameId  string
+	name     string
+	// the context of the page world, the others are isolated worlds of user scripts or of WebKit
+	isDefault bool
+}
+
+// executionContexts is the registry of the contexts announced to the tool, WebKit never says when one is gone
+type executionContexts struct {
+	lock        sync.Mutex
+	mainFrameId string
+	// incremented by every clear, context ids of a new target start again and need new unique ids
+	generation int
+	contexts   map[int64]*executionContext
+	// security origin of the document of each frame, the origin of its contexts
+	origins map[string]string
+	// frame of the documents and scripts by url, ConsoleMessage only tells the url of the code that logged
+	resourceFrames map[string]string
+	// url of the scripts by scriptId, call frames of older WebKit come without url
+	scriptURLs map[string]string
+}
+
+func newExecutionContexts() *executionContexts {
+	return &executionContexts{
+		contexts:       make(map[int64]*executionContext),
+		origins:        make(map[string]string),
+		resourceFrames: make(map[string]string),
+		scriptURLs:     make(map[string]string),
+	}
+}
+
+func (r *executionContexts) setResourceFrame(url string, frameId string) {
+	if url == "" || frameId == "" {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.resourceFrames[strings.SplitN(url, "#", 2)[0]] = frameId
+}
+
+func (r *executionContexts) scriptParsed(scriptId string, url string) {
+	if url == "" {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.scriptURLs[scriptId] = url
+}
+
+// defaultContextOf returns the page world context of the frame that loaded the script or document at url,
+// or of the frame of scriptId when url is empty
+func (r *executionContexts) defaultContextOf(url string, scriptId string) (int64, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if url == "" {
+		url = r.scriptURLs[scriptId]
+	}
+	if url == "" {
+		return 0, false
+	}
+	frameId, ok := r.resourceFrames[strings.SplitN(url, "#", 2)[0]]
+	if !ok {
+		return 0, false
+	}
+	for _, context := range r.contexts {
+		if context.isDefault && context.frameId == frameId {
+			return context.id, true
+		}
+	}
+	return 0, false
+}
+
+func (r *executionContexts) setOrigin(frameId string, origin string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.origins[frameId] = origin
+}
+
+func (r *executionContexts) origin(frameId string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.origins[frameId]
+}
+
+func (r *executionContexts) setMainFrame(frameId string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.mainFrameId = frameId
+}
+
+// add registers context and returns the contexts it replaces. A default context means a new document in its frame,
+// every context of the previous document is gone then, all of them when the frame is the main one.
+func (r *executionContexts) add(context *executionContext) (destroyed []*executionContext, cleared bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	context.uniqueId = strconv.Itoa(r.generation) + "." + strconv.FormatInt(context.id, 10)
+	if context.isDefault {
+		if context.frameId != "" && context.frameId == r.mainFrameId && len(r.contexts) > 0 {
+			r.contexts = make(map[int64]*executionContext)
+			cleared = true
+		} else {
+			destroyed = r.removeFrame(context.frameId)
+		}
+	}
+	r.contexts[context.id] = context
+	return destroyed, cleared
+}
+
+// isMainFrame also holds while the main frame is not known yet, its context comes first
+func (r *executionContexts) isMainFrame(frameId string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return frameId == "" || r.mainFrameId == "" || r.mainFrameId == frameId
+}
+
+func (r *executionContexts) removeFrame(frameId string) []*executionContext {
+	var destroyed []*executionContext
+	for id, context := range r.contexts {
+		if context.frameId == frameId {
+			destroyed = append(destroyed, context)
+			delete(r.contexts, id)
+		}
+	}
+	return destroyed
+}
+
+func (r *executionContexts) frameDetached(frameId string) []*executionContext {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.origins, frameId)
+	for url, resourceFrameId := range r.resourceFrames {
+		if resourceFrameId == frameId {
+			delete(r.resourceFrames, url)
+		}
+	}
+	return r.removeFrame(frameId)
+}
+
+// clear forgets every context and tells whether there was any
+func (r *executionContexts) clear() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.generation++
+	hadContexts := len(r.contexts) > 0
+	r.contexts = make(map[int64]*executionContext)
+	r.origins = make(map[string]string)
+	r.resourceFrames = make(map[string]string)
+	r.scriptURLs = make(map[string]string)
+	return hadContexts
+}
+
+// named returns the contexts called name, the isolated worlds of one name in every frame
+func (r *executionContexts) named(name string) []int64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var ids []int64
+	for _, context := range r.contexts {
+		if context.name == name {
+			ids = append(ids, context.id)
+		}
+	}
+	return ids
+}
+
+func (r *executionContexts) byUniqueId(uniqueId string) (int64, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, context := range r.contexts {
+		if context.uniqueId == uniqueId {
+			return context.id, true
+		}
+	}
+	return 0, false
+}
+
+// contextId is the WebKit context a tool request targets, uniqueContextId wins over the numeric id like in Chrome
+func (p *protocolAdapter) contextId(params gjson.Result, idKey string) (int64, bool) {
+	if uniqueId := params.Get("uniqueContextId"); uniqueId.Exists() {
+		return p.executionContexts.byUniqueId(uniqueId.String())
+	}
+	if id := params.Get(idKey); id.Exists() {
+		return id.Int(), true
+	}
+	return 0, false
+}
+
+// messageContextId is the context a ConsoleMessage was logged from, found by the url of its first call frame or
+// its own url, the page context when the url is not known
+func (p *protocolAdapter) messageContextId(message gjson.Result) int64 {
+	stackTrace := message.Get("stackTrace")
+	if !stackTrace.IsArray() {
+		stackTrace = stackTrace.Get("callFrames")
+	}
+	if callFrame := stackTrace.Get("0"); callFrame.Exists() {
+		if id, ok := p.executionContexts.defaultContextOf(callFrame.Get("url").String(), callFrame.Get("scriptId").String()); ok {
+			return id
+		}
+	}
+	if id, ok := p.executionContexts.defaultContextOf(message.Get("url").String(), ""); ok {
+		return id
+	}
+	return p.lastPageExecutionContextId
+}
+
+func (p *protocolAdapter) fireContextsDestroyed(destroyed []*executionContext) {
+	for _, context := range destroyed {
+		p.adapter.FireEventToTools("Runtime.executionContextDestroyed", map[string]interface{}{
+			"executionContextId":       context.id,
+			"executionContextUniqueId": context.uniqueId,
+		})
+	}
+}
+
+// clearExecutionContexts drops the contexts of a target that went away
+func (p *protocolAdapter) clearExecutionContexts() {
+	if p.executionContexts.clear() {
+		p.adapter.FireEventToTools("Runtime.executionContextsCleared", map[string]interface{}{})
+	}
+}
+
+// readFrameOrigins records the security origin of every frame of the resource tree, then calls done.
+// The contexts that exist when the tool attaches are announced before any frame navigates.
+func (p *protocolAdapter) readFrameOrigins(done func()) {
+	p.adapter.CallTarget("Page.getResourceTree", map[string]interface{}{}, func(result []byte) {
+		if !isWebkitError(result) {
+			p.recordFrameOrigins(gjson.GetBytes(result, "frameTree"))
+		}
+		done()
+	})
+}
+
+func (p *protocolAdapter) recordFrameOrigins(frameTree gjson.Result) {
+	frame := frameTree.Get("frame")
+	if frame.Exists() {
+		frameId := frame.Get("id").String()
+		p.executionContexts.setOrigin(frameId, frame.Get("securityOrigin").String())
+		p.executionContexts.setResourceFrame(frame.Get("url").String(), frameId)
+		for _, resource := range frameTree.Get("resources").Array() {
+			p.executionContexts.setResourceFrame(resource.Get("url").String(), frameId)
+		}
+	}
+	for _, child := range frameTree.Get("childFrames").Array() {
+		p.recordFrameOrigins(child)
+	}
+}
+
+// onExecutionContextCreated announces the contexts of the page frames. Workers are WebKit targets of their own that
+// the adapter does not attach to, see iOS12.targetCreated, no worker context is announced.
+func (p *protocolAdapter) onExecutionContextCreated(message []byte) []byte {
+	webkitContext := gjson.GetBytes(message, "params.context")
+	if !webkitContext.Exists() {
+		return message
+	}
+	// WebKit types are normal, user and internal, older versions only flag the page context
+	isDefault := webkitContext.Get("type").String() == "normal" || webkitContext.Get("isPageContext").Bool()
+	context := &executionContext{
+		id:        webkitContext.Get("id").Int(),
+		frameId:   webkitContext.Get("frameId").String(),
+		name:      webkitContext.Get("name").String(),
+		isDefault: isDefault,
+	}
+	destroyed, cleared := p.executionContexts.add(context)
+	if cleared {
+		p.adapter.FireEventToTools("Runtime.executionContextsCleared", map[string]interface{}{})
+	}
+	p.fireContextsDestroyed(destroyed)
+
+	contextType := "isolated"
+	if isDefault {
+		contextType = "default"
+		if p.executionContexts.isMainFrame(context.frameId) {
+			p.lastPageExecutionContextId = context.id
+		} else {
+			p.watchContentLoaded(context.frameId, context.id)
+		}
+	}
+	p.adapter.FireEventToTools("Runtime.executionContextCreated", map[string]interface{}{
+		"context": map[string]interface{}{
+			"id":       context.id,
+			"origin":   p.executionContexts.origin(context.frameId),
+			"name":     context.name,
+			"uniqueId": context.uniqueId,
+			"auxData": map[string]interface{}{
+				"frameId":   context.frameId,
+				"isDefault": isDefault,
+				"type":      contextType,
+			},
+		},
+	})
+	p.installContextBindings(context.id, context.name)
+	return nil
+}
+
+func (p *protocolAdapter) onFrameDetached(message []byte) []byte {
+	p.fireContextsDestroyed(p.executionContexts.frameDetached(gjson.GetBytes(message, "params.frameId").String()))
+	return message
+}
@@ -0,0 +1,324 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"errors"
+	"github.com/tidwall/gjson"
+	"math"
+	"time"
+)
+
+// delay between two steps of a gesture, one frame at 60 fps
+const gestureStepInterval = 16 * time.Millisecond
+
+// bound of a single step evaluated by a gesture
+const gestureStepTimeout = 10 * time.Second
+
+// pause between the taps of a multi tap gesture
+const gestureTapInterval = 100 * time.Millisecond
+
+const (
+	defaultTapDuration      = 50 * time.Millisecond
+	defaultScrollSpeed      = 800
+	defaultScrollRepeatWait = 250 * time.Millisecond
+	defaultPinchSpeed       = 800
+	// distance between the two fingers of a pinch when the gesture starts, CSS pixels
+	pinchStartSpan = 100
+)
+
+type gesturePoint struct {
+	id int
+	x  float64
+	y  float64
+}
+
+// gesture plays a Input.synthesize*Gesture as timed steps of inputShim commands
+type gesture struct {
+	protocol *protocolAdapter
+	// gestureSourceType mouse uses mouse and wheel events instead of touches
+	mouse bool
+}
+
+func (p *protocolAdapter) newGesture(params gjson.Result) *gesture {
+	return &gesture{
+		protocol: p,
+		mouse:    params.Get("gestureSourceType").String() == "mouse",
+	}
+}
+
+// runGesture plays the gesture in the background and replies once it completed
+func (p *protocolAdapter) runGesture(id int, play func() error) {
+	go func() {
+		if err := play(); err != nil {
+			p.adapter.FireErrorToTools(id, serverErrorCode, err.Error())
+			return
+		}
+		p.adapter.FireResultToTools(id, map[string]interface{}{})
+	}()
+}
+
+// step evaluates one inputShim command and waits until the page ran it
+func (g *gesture) step(command map[string]interface{}) error {
+	expression, err := inputExpression(command)
+	if err != nil {
+		return err
+	}
+	result := make(chan []byte, 1)
+	g.protocol.adapter.CallTarget("Runtime.evaluate", map[string]interface{}{
+		"expression":    expression,
+		"returnByValue": true,
+	}, func(message []byte) {
+		result <- message
+	})
+	select {
+	case message := <-result:
+		if gjson.GetBytes(message, "wasThrown").Bool() {
+			return errors.New("gesture step failed: " + gjson.GetBytes(message, "result.description").String())
+		}
+		return nil
+	case <-time.After(gestureStepTimeout):
+		return errors.New("gesture step timed out")
+	}
+}
+
+func (g *gesture) touch(eventType string, points ...gesturePoint) error {
+	touchPoints := []map[string]interface{}{}
+	for _, point := range points {
+		touchPoints = append(touchPoints, map[string]interface{}{
+			"id":            point.id,
+			"x":             point.x,
+			"y":             point.y,
+			"radiusX":       1,
+			"radiusY":       1,
+			"rotationAngle": 0,
+			"force":         1,
+		})
+	}
+	return g.step(map[string]interface{}{
+		"kind":           "touch",
+		"type":           eventType,
+		"touchPoints":    touchPoints,
+		"visualViewport": true,
+	})
+}
+
+func (g *gesture) mouseEvent(x float64, y float64, types []string, clickCount int, deltaX float64, deltaY float64) error {
+	buttons := 0
+	if len(types) > 0 && types[0] == "mousedown" {
+		buttons = 1
+	}
+	return g.step(map[string]interface{}{
+		"kind":           "mouse",
+		"types":          types,
+		"x":              x,
+		"y":              y,
+		"button":         0,
+		"buttons":        buttons,
+		"clickCount":     clickCount,
+		"deltaX":         deltaX,
+		"deltaY":         deltaY,
+		"visualViewport": true,
+	})
+}
+
+func (g *gesture) scroll(x float64, y float64, deltaX float64, deltaY float64) error {
+	return g.step(map[string]interface{}{
+		"kind":           "scroll",
+		"x":              x,
+		"y":              y,
+		"deltaX":         deltaX,
+		"deltaY":         deltaY,
+		"visualViewport": true,
+	})
+}
+
+// tap presses for duration tapCount times
+func (g *gesture) tap(x float64, y float64, duration time.Duration, tapCount int) error {
+	for i := 0; i < tapCount; i++ {
+		if i > 0 {
+			time.Sleep(gestureTapInterval)
+		}
+		if g.mouse {
+			if err := g.mouseEvent(x, y, []string{"mousedown"}, i+1, 0, 0); err != nil {
+				return err
+			}
+			time.Sleep(duration)
+			types := []string{"mouseup", "click"}
+			if i == 1 {
+				types = append(types, "dblclick")
+			}
+			if err := g.mouseEvent(x, y, types, i+1, 0, 0); err != nil {
+				return err
+			}
+			continue
+		}
+		point := gesturePoint{x: x, y: y}
+		if err := g.touch("touchStart", point); err != nil {
+			return err
+		}
+		time.Sleep(duration)
+		// touchEnd without points lifts the finger, inputShim follows with the click of the tap
+		if err := g.touch("touchEnd"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// swipe moves a finger, or the wheel, by distanceX x distanceY at speed CSS pixels per second,
+// the content scrolls the opposite way of the finger
+func (g *gesture) swipe(x float64, y float64, distanceX float64, distanceY float64, speed float64) error {
+	distance := math.Hypot(distanceX, distanceY)
+	steps := int(math.Ceil(distance / speed * float64(time.Second) / float64(gestureStepInterval)))
+	if steps < 1 {
+		steps = 1
+	}
+	stepX := distanceX / float64(steps)
+	stepY := distanceY / float64(steps)
+
+	if !g.mouse {
+		if err := g.touch("touchStart", gesturePoint{x: x, y: y}); err != nil {
+			return err
+		}
+	}
+	for i := 1; i <= steps; i++ {
+		time.Sleep(gestureStepInterval)
+		if g.mouse {
+			// the wheel event scrolls once the page did not cancel it
+			if err := g.mouseEvent(x, y, []string{"wheel"}, 0, -stepX, -stepY); err != nil {
+				return err
+			}
+			continue
+		}
+		// synthesized touches do not scroll by themselves
+		fingerX := x + stepX*float64(i)
+		fingerY := y + stepY*float64(i)
+		if err := g.touch("touchMove", gesturePoint{x: fingerX, y: fingerY}); err != nil {
+			return err
+		}
+		if err := g.scroll(x, y, -stepX, -stepY); err != nil {
+			return err
+		}
+	}
+	if !g.mouse {
+		return g.touch("touchEnd")
+	}
+	return nil
+}
+
+// pinch moves two fingers symmetrically around x, y until their span is multiplied by scaleFactor.
+// The page gets the touches, the native zoom of the WebView cannot be driven by synthesized events.
+func (g *gesture) pinch(x float64, y float64, scaleFactor float64, speed float64) error {
+	startSpan := float64(pinchStartSpan)
+	endSpan := startSpan * scaleFactor
+	steps := int(math.Ceil(math.Abs(endSpan-startSpan) / 2 / speed * float64(time.Second) / float64(gestureStepInterval)))
+	if steps < 1 {
+		steps = 1
+	}
+	fingers := func(span float64) []gesturePoint {
+		return []gesturePoint{
+			{id: 0, x: x - span/2, y: y},
+			{id: 1, x: x + span/2, y: y},
+		}
+	}
+	if err := g.touch("touchStart", fingers(startSpan)...); err != nil {
+		return err
+	}
+	for i := 1; i <= steps; i++ {
+		time.Sleep(gestureStepInterval)
+		span := startSpan + (endSpan-startSpan)*float64(i)/float64(steps)
+		if err := g.touch("touchMove", fingers(span)...); err != nil {
+			return err
+		}
+	}
+	return g.touch("touchEnd")
+}
+
+func (p *protocolAdapter) onSynthesizeTapGesture(message []byte) []byte {
+	msg := string(message)
+	id := int(gjson.Get(msg, "id").Int())
+	params := gjson.Get(msg, "params")
+	duration := defaultTapDuration
+	if params.Get("duration").Exists() {
+		duration = time.Duration(params.Get("duration").Int()) * time.Millisecond
+	}
+	tapCount := 1
+	if params.Get("tapCount").Exists() {
+		tapCount = int(params.Get("tapCount").Int())
+	}
+	g := p.newGesture(params)
+	p.runGesture(id, func() error {
+		return g.tap(params.Get("x").Float(), params.Get("y").Float(), duration, tapCount)
+	})
+	return nil
+}
+
+func (p *protocolAdapter) onSynthesizeScrollGesture(message []byte) []byte {
+	msg := string(message)
+	id := int(gjson.Get(msg, "id").Int())
+	params := gjson.Get(msg, "params")
+	speed := float64(defaultScrollSpeed)
+	if params.Get("speed").Exists() && params.Get("speed").Float() > 0 {
+		speed = params.Get("speed").Float()
+	}
+	repeatDelay := defaultScrollRepeatWait
+	if params.Get("repeatDelayMs").Exists() {
+		repeatDelay = time.Duration(params.Get("repeatDelayMs").Int()) * time.Millisecond
+	}
+	// overscroll is played as extra finger travel
+	distanceX := params.Get("xDistance").Float() + params.Get("xOverscroll").Float()
+	distanceY := params.Get("yDistance").Float() + params.Get("yOverscroll").Float()
+	repeatCount := int(params.Get("repeatCount").Int())
+	g := p.newGesture(params)
+	p.runGesture(id, func() error {
+		for i := 0; i <= repeatCount; i++ {
+			if i > 0 {
+				time.Sleep(repeatDelay)
+			}
+			if err := g.swipe(params.Get("x").Float(), params.Get("y").Float(), distanceX, distanceY, speed); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return nil
+}
+
+func (p *protocolAdapter) onSynthesizePinchGesture(message []byte) []byte {
+	msg := string(message)
+	id := int(gjson.Get(msg, "id").Int())
+	params := gjson.Get(msg, "params")
+	scaleFactor := params.Get("scaleFactor").Float()
+	if scaleFactor <= 0 {
+		p.adapter.FireErrorToTools(id, serverErrorCode, "scaleFactor must be positive")
+		return nil
+	}
+	speed := float64(defaultPinchSpeed)
+	if params.Get("relativeSpeed").Exists() && params.Get("relativeSpeed").Float() > 0 {
+		speed = params.Get("relativeSpeed").Float()
+	}
+	g := p.newGesture(params)
+	if g.mouse {
+		p.adapter.FireErrorToTools(id, serverErrorCode, "Pinch gestures are only supported with touch input")
+		return nil
+	}
+	p.runGesture(id, func() error {
+		return g.pinch(params.Get("x").Float(), params.Get("y").Float(), scaleFactor, speed)
+	})
+	return nil
+}
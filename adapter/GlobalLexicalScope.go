@@ -0,0 +1,280 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"github.com/tidwall/gjson"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// names that can be written in a check expression as they are
+var plainIdentifierPattern = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+// globalScripts remembers the classic scripts of the document and the lexical declarations found in their source
+type globalScripts struct {
+	lock sync.Mutex
+	// declared names by script id, nil until the source was read
+	scripts map[string][]string
+}
+
+func newGlobalScripts() *globalScripts {
+	return &globalScripts{
+		scripts: make(map[string][]string),
+	}
+}
+
+func (g *globalScripts) parsed(scriptId string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if _, ok := g.scripts[scriptId]; !ok {
+		g.scripts[scriptId] = nil
+	}
+}
+
+func (g *globalScripts) declared(scriptId string, names []string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if _, ok := g.scripts[scriptId]; ok {
+		g.scripts[scriptId] = names
+	}
+}
+
+// unread returns the scripts whose source was not read yet
+func (g *globalScripts) unread() []string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	var scriptIds []string
+	for scriptId, names := range g.scripts {
+		if names == nil {
+			scriptIds = append(scriptIds, scriptId)
+		}
+	}
+	return scriptIds
+}
+
+func (g *globalScripts) names() []string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	unique := make(map[string]bool)
+	for _, names := range g.scripts {
+		for _, name := range names {
+			unique[name] = true
+		}
+	}
+	var names []string
+	for name := range unique {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (g *globalScripts) clear() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.scripts = make(map[string][]string)
+}
+
+// lexicalDeclarations finds the names declared by let, const and class outside of any block, function or
+// parenthesis of source. It is a scanner and no parser, the names are checked in the page afterwards.
+func lexicalDeclarations(source string) []string {
+	text := []rune(source)
+	names := []string{}
+	depth := 0
+	// depth of the let or const being read, -1 outside of a declaration
+	declarationDepth := -1
+	expectBinding := false
+	expectClassName := false
+	endsValue := false
+	for i := 0; i < len(text); {
+		r := text[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '/' && i+1 < len(text) && text[i+1] == '/':
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+			continue
+		case r == '/' && i+1 < len(text) && text[i+1] == '*':
+			i += 2
+			for i+1 < len(text) && !(text[i] == '*' && text[i+1] == '/') {
+				i++
+			}
+			i += 2
+			continue
+		case r == '\'' || r == '"' || r == '`':
+			end, ok := skipString(text, i)
+			if !ok {
+				return names
+			}
+			i = end
+			endsValue = true
+			continue
+		case r == '/' && !endsValue:
+			end, ok := skipRegExp(text, i)
+			if !ok {
+				i++
+				continue
+			}
+			i = end
+			endsValue = true
+			continue
+		case isIdentifierStart(r) || unicode.IsDigit(r):
+			start := i
+			for i < len(text) && isIdentifierPart(text[i]) {
+				i++
+			}
+			word := string(text[start:i])
+			switch {
+			case expectClassName:
+				names = append(names, word)
+				expectClassName = false
+			case expectBinding:
+				names = append(names, word)
+				expectBinding = false
+			case depth == 0 && (word == "let" || word == "const"):
+				declarationDepth = 0
+				expectBinding = true
+			case depth == 0 && word == "class":
+				expectClassName = true
+			}
+			endsValue = true
+			continue
+		}
+		expectClassName = false
+		switch r {
+		case '{', '(', '[':
+			if expectBinding {
+				// destructuring patterns are not followed
+				declarationDepth = -1
+				expectBinding = false
+			}
+			depth++
+		case '}', ')', ']':
+			if depth > 0 {
+				depth--
+			}
+		case ',':
+			expectBinding = declarationDepth >= 0 && depth == declarationDepth
+		case ';':
+			declarationDepth = -1
+			expectBinding = false
+		}
+		endsValue = r == ')' || r == ']' || r == '}'
+		i++
+	}
+	return names
+}
+
+// lexicalScopeCheck keeps the names the global scope resolves without being properties of the global object,
+// a reference never calls anything when the name is not a property
+func lexicalScopeCheck(names []string) string {
+	var builder strings.Builder
+	builder.WriteString("(function() {\n    const names = [];\n")
+	for _, name := range names {
+		if !plainIdentifierPattern.MatchString(name) {
+			continue
+		}
+		builder.WriteString("    if (!('" + name + "' in window)) {\n        try {\n            void " + name +
+			";\n            names.push('" + name + "');\n        } catch (e) {\n        }\n    }\n")
+	}
+	builder.WriteString("    return names;\n})()")
+	return builder.String()
+}
+
+// readScriptSources reads the sources not read yet, then calls done
+func (p *protocolAdapter) readScriptSources(done func()) {
+	scriptIds := p.globalScripts.unread()
+	remaining := len(scriptIds)
+	if remaining == 0 {
+		done()
+		return
+	}
+	var lock sync.Mutex
+	for _, scriptId := range scriptIds {
+		scriptId := scriptId
+		p.adapter.CallTarget("Debugger.getScriptSource", map[string]interface{}{
+			"scriptId": scriptId,
+		}, func(result []byte) {
+			names := []string{}
+			if !isWebkitError(result) {
+				names = lexicalDeclarations(gjson.GetBytes(result, "scriptSource").String())
+			}
+			p.globalScripts.declared(scriptId, names)
+			lock.Lock()
+			remaining--
+			last := remaining == 0
+			lock.Unlock()
+			if last {
+				done()
+			}
+		})
+	}
+}
+
+func (p *protocolAdapter) onGlobalLexicalScopeNames(message []byte) []byte {
+	msg := string(message)
+	id := int(gjson.Get(msg, "id").Int())
+	params := gjson.Get(msg, "params")
+	contextId, hasContext := p.contextId(params, "executionContextId")
+	p.readScriptSources(func() {
+		names := p.globalScripts.names()
+		if len(names) == 0 {
+			p.adapter.FireResultToTools(id, map[string]interface{}{"names": []string{}})
+			return
+		}
+		evaluateParams := map[string]interface{}{
+			"expression":                           lexicalScopeCheck(names),
+			"returnByValue":                        true,
+			"doNotPauseOnExceptionsAndMuteConsole": true,
+		}
+		if hasContext {
+			evaluateParams["contextId"] = contextId
+		}
+		p.adapter.CallTarget("Runtime.evaluate", evaluateParams, func(result []byte) {
+			names := []string{}
+			if !isWebkitError(result) && !gjson.GetBytes(result, "wasThrown").Bool() {
+				for _, name := range gjson.GetBytes(result, "result.value").Array() {
+					names = append(names, name.String())
+				}
+			}
+			p.adapter.FireResultToTools(id, map[string]interface{}{"names": names})
+		})
+	})
+	return nil
+}
+
+// onScriptParsed remembers the classic scripts, the declarations of a module are not global
+func (p *protocolAdapter) onScriptParsed(message []byte) []byte {
+	params := gjson.GetBytes(message, "params")
+	p.executionContexts.scriptParsed(params.Get("scriptId").String(), params.Get("url").String())
+	if !params.Get("module").Bool() {
+		p.globalScripts.parsed(params.Get("scriptId").String())
+	}
+	return message
+}
+
+func (p *protocolAdapter) onGlobalObjectCleared(message []byte) []byte {
+	p.globalScripts.clear()
+	return message
+}
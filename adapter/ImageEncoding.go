@@ -0,0 +1,138 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"strings"
+)
+
+// default quality of lossy formats when the tool does not pass one
+const defaultImageQuality = 80
+
+// splitDataURL returns the base64 payload of a data URL produced by Page.snapshotRect
+func splitDataURL(dataURL string) (string, error) {
+	index := strings.Index(dataURL, "base64,")
+	if !strings.HasPrefix(dataURL, "data:") || index < 0 {
+		return "", errors.New("snapshot did not return a base64 data URL")
+	}
+	return dataURL[index+len("base64,"):], nil
+}
+
+func decodeDataURL(dataURL string) (image.Image, error) {
+	payload, err := splitDataURL(dataURL)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+	return png.Decode(bytes.NewReader(data))
+}
+
+// toNRGBA converts img to non-premultiplied RGBA starting at the origin
+func toNRGBA(img image.Image) *image.NRGBA {
+	if nrgba, ok := img.(*image.NRGBA); ok && nrgba.Rect.Min == (image.Point{}) {
+		return nrgba
+	}
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(nrgba, nrgba.Rect, img, bounds.Min, draw.Src)
+	return nrgba
+}
+
+// scaleImage resizes img to width x height, averaging the covered source pixels when shrinking
+func scaleImage(img image.Image, width int, height int) *image.NRGBA {
+	src := toNRGBA(img)
+	srcWidth := src.Rect.Dx()
+	srcHeight := src.Rect.Dy()
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	if width == srcWidth && height == srcHeight {
+		return src
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		sy0 := y * srcHeight / height
+		sy1 := (y + 1) * srcHeight / height
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for x := 0; x < width; x++ {
+			sx0 := x * srcWidth / width
+			sx1 := (x + 1) * srcWidth / width
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+			var r, g, b, a, count int
+			for sy := sy0; sy < sy1; sy++ {
+				offset := sy*src.Stride + sx0*4
+				for sx := sx0; sx < sx1; sx++ {
+					r += int(src.Pix[offset])
+					g += int(src.Pix[offset+1])
+					b += int(src.Pix[offset+2])
+					a += int(src.Pix[offset+3])
+					offset += 4
+					count++
+				}
+			}
+			offset := y*dst.Stride + x*4
+			dst.Pix[offset] = uint8(r / count)
+			dst.Pix[offset+1] = uint8(g / count)
+			dst.Pix[offset+2] = uint8(b / count)
+			dst.Pix[offset+3] = uint8(a / count)
+		}
+	}
+	return dst
+}
+
+// encodeImage encodes img in the CDP screenshot format, jpeg, png or webp
+func encodeImage(img image.Image, format string, quality int) ([]byte, error) {
+	var buffer bytes.Buffer
+	var err error
+	switch format {
+	case "jpeg", "jpg":
+		if quality <= 0 || quality > 100 {
+			quality = defaultImageQuality
+		}
+		err = jpeg.Encode(&buffer, img, &jpeg.Options{Quality: quality})
+	case "webp":
+		// Go has no lossy WebP encoder, lossless output is valid for every quality
+		var data []byte
+		data, err = encodeWebPLossless(toNRGBA(img))
+		buffer.Write(data)
+	case "png", "":
+		err = png.Encode(&buffer, img)
+	default:
+		err = errors.New("unsupported image format " + format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,118 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestScaleImageSameSize(t *testing.T) {
+	src := gradientImage(20, 10)
+	if scaled := scaleImage(src, 20, 10); scaled != src {
+		t.Fatal("scaling to the same size should return the source")
+	}
+}
+
+func TestScaleImageAveragesWhenShrinking(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	// left 2x2 block averages to 100, right one to 30 with half transparency
+	for _, pixel := range []struct {
+		x, y int
+		c    color.NRGBA
+	}{
+		{0, 0, color.NRGBA{R: 0, G: 0, B: 0, A: 255}},
+		{1, 0, color.NRGBA{R: 200, G: 200, B: 200, A: 255}},
+		{0, 1, color.NRGBA{R: 100, G: 100, B: 100, A: 255}},
+		{1, 1, color.NRGBA{R: 100, G: 100, B: 100, A: 255}},
+		{2, 0, color.NRGBA{R: 60, G: 0, B: 0, A: 255}},
+		{3, 0, color.NRGBA{R: 60, G: 0, B: 0, A: 255}},
+		{2, 1, color.NRGBA{R: 0, G: 0, B: 0, A: 0}},
+		{3, 1, color.NRGBA{R: 0, G: 0, B: 0, A: 0}},
+	} {
+		src.SetNRGBA(pixel.x, pixel.y, pixel.c)
+	}
+	scaled := scaleImage(src, 2, 1)
+	if got, want := scaled.NRGBAAt(0, 0), (color.NRGBA{R: 100, G: 100, B: 100, A: 255}); got != want {
+		t.Errorf("left pixel is %v, want %v", got, want)
+	}
+	if got, want := scaled.NRGBAAt(1, 0), (color.NRGBA{R: 30, G: 0, B: 0, A: 127}); got != want {
+		t.Errorf("right pixel is %v, want %v", got, want)
+	}
+}
+
+func TestScaleImageRepeatsWhenGrowing(t *testing.T) {
+	src := gradientImage(2, 2)
+	scaled := scaleImage(src, 4, 4)
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			if got, want := scaled.NRGBAAt(x, y), src.NRGBAAt(x/2, y/2); got != want {
+				t.Fatalf("pixel (%d, %d) is %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestScaleImageBounds(t *testing.T) {
+	src := gradientImage(30, 20)
+	// a sub image does not start at the origin
+	sub := src.SubImage(image.Rect(10, 10, 20, 20))
+	scaled := scaleImage(sub, 10, 10)
+	if got, want := scaled.NRGBAAt(0, 0), src.NRGBAAt(10, 10); got != want {
+		t.Errorf("first pixel of the sub image is %v, want %v", got, want)
+	}
+	if size := scaleImage(src, 0, -3).Rect.Size(); size != (image.Point{X: 1, Y: 1}) {
+		t.Errorf("size %v, sizes below one pixel should give one pixel", size)
+	}
+	if size := scaleImage(src, 7, 3).Rect.Size(); size != (image.Point{X: 7, Y: 3}) {
+		t.Errorf("size %v, want 7x3", size)
+	}
+}
+
+func TestEncodeImageFormats(t *testing.T) {
+	src := gradientImage(16, 8)
+	data, err := encodeImage(src, "png", 0)
+	if err != nil {
+		t.Fatalf("png: %v", err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("png decode: %v", err)
+	}
+	assertSamePixels(t, src, decoded)
+
+	for _, format := range []string{"jpeg", "jpg"} {
+		data, err = encodeImage(src, format, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if decoded, err = jpeg.Decode(bytes.NewReader(data)); err != nil {
+			t.Fatalf("%s decode: %v", format, err)
+		}
+		if decoded.Bounds().Size() != src.Rect.Size() {
+			t.Errorf("%s size %v, want %v", format, decoded.Bounds().Size(), src.Rect.Size())
+		}
+	}
+
+	if _, err = encodeImage(src, "gif", 0); err == nil {
+		t.Error("unsupported formats should fail")
+	}
+}
@@ -0,0 +1,571 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"github.com/yezihack/e"
+	"log"
+)
+
+// inputShim synthesizes DOM events for the Input domain, WebKit has no input injection over the inspector.
+// Mouse and touch points are client coordinates, or visual viewport coordinates when visualViewport is set.
+// Active touches are kept on window so touchMove and touchEnd find the targets of touchStart.
+const inputShim = `function dispatchInput(command) {
+    const modifiers = command.modifiers || 0;
+    const keyState = {
+        altKey: (modifiers & 1) === 1,
+        ctrlKey: (modifiers & 2) === 2,
+        metaKey: (modifiers & 4) === 4,
+        shiftKey: (modifiers & 8) === 8
+    };
+    const toClient = (x, y) => {
+        if (!command.visualViewport || !window.visualViewport) {
+            return {x: x, y: y};
+        }
+        return {x: x + window.visualViewport.offsetLeft, y: y + window.visualViewport.offsetTop};
+    };
+    const nonTextInputs = ['button', 'checkbox', 'color', 'file', 'hidden', 'image', 'radio', 'range', 'reset', 'submit'];
+    const isEditable = (element) => !!element && !element.disabled && !element.readOnly && (element.isContentEditable ||
+        element.tagName === 'TEXTAREA' || (element.tagName === 'INPUT' && nonTextInputs.indexOf(element.type) < 0));
+    const focusTarget = (element) => {
+        for (let node = element; node && node !== document.body; node = node.parentElement) {
+            if (typeof node.focus === 'function' && (node.tabIndex >= 0 || isEditable(node))) {
+                if (document.activeElement !== node) {
+                    node.focus();
+                }
+                return;
+            }
+        }
+        if (document.activeElement && document.activeElement !== document.body && document.activeElement.blur) {
+            document.activeElement.blur();
+        }
+    };
+    const selectionOf = (element) => {
+        try {
+            if (element.selectionStart !== null) {
+                return {start: element.selectionStart, end: element.selectionEnd};
+            }
+        } catch (e) {
+        }
+        return null;
+    };
+    const editText = (inputType, text, forward) => {
+        const element = document.activeElement;
+        if (!isEditable(element)) {
+            return false;
+        }
+        const data = text === undefined ? null : text;
+        if (!element.dispatchEvent(new InputEvent('beforeinput', {inputType: inputType, data: data, bubbles: true, cancelable: true}))) {
+            return true;
+        }
+        if (element.isContentEditable) {
+            // execCommand fires the input event itself
+            if (inputType === 'insertText') {
+                document.execCommand('insertText', false, text);
+            } else {
+                document.execCommand(forward ? 'forwardDelete' : 'delete');
+            }
+            return true;
+        }
+        const selection = selectionOf(element);
+        if (inputType === 'insertText') {
+            if (selection) {
+                element.setRangeText(text, selection.start, selection.end, 'end');
+            } else {
+                element.value += text;
+            }
+        } else {
+            if (!selection) {
+                element.value = element.value.slice(0, -1);
+            } else {
+                let start = selection.start;
+                let end = selection.end;
+                if (start === end) {
+                    if (forward) {
+                        end = Math.min(end + 1, element.value.length);
+                    } else {
+                        start = Math.max(start - 1, 0);
+                    }
+                }
+                if (start === end) {
+                    return true;
+                }
+                element.setRangeText('', start, end, 'end');
+            }
+        }
+        element.dispatchEvent(new InputEvent('input', {inputType: inputType, data: data, bubbles: true}));
+        return true;
+    };
+    const scrollFrom = (element, deltaX, deltaY) => {
+        for (let node = element; node && node !== document.body && node !== document.documentElement; node = node.parentElement) {
+            const style = getComputedStyle(node);
+            const canScrollX = deltaX !== 0 && /(auto|scroll)/.test(style.overflowX) && node.scrollWidth > node.clientWidth;
+            const canScrollY = deltaY !== 0 && /(auto|scroll)/.test(style.overflowY) && node.scrollHeight > node.clientHeight;
+            if (canScrollX || canScrollY) {
+                node.scrollBy(deltaX, deltaY);
+                return;
+            }
+        }
+        window.scrollBy(deltaX, deltaY);
+    };
+    const dispatchMouse = (element, types, init) => {
+        for (const type of types) {
+            if (type === 'wheel') {
+                const wheel = new WheelEvent('wheel', Object.assign({deltaX: command.deltaX, deltaY: command.deltaY, deltaMode: 0}, init));
+                if (element.dispatchEvent(wheel)) {
+                    scrollFrom(element, command.deltaX, command.deltaY);
+                }
+                continue;
+            }
+            const accepted = element.dispatchEvent(new MouseEvent(type, init));
+            if (type === 'mousedown' && accepted) {
+                focusTarget(element);
+            }
+        }
+    };
+    // the browser fires the transitions of the element under the pointer before the event itself, the last hit
+    // target is kept in the document
+    const hover = (element, init) => {
+        const state = window.__sonicHover || (window.__sonicHover = {target: null});
+        const previous = state.target && state.target.isConnected ? state.target : null;
+        state.target = element;
+        if (previous === element) {
+            return;
+        }
+        const ancestors = (node) => {
+            const nodes = [];
+            for (; node; node = node.parentElement) {
+                nodes.push(node);
+            }
+            return nodes;
+        };
+        const left = ancestors(previous);
+        const entered = ancestors(element);
+        const transition = (node, type, relatedTarget, bubbles) => node.dispatchEvent(new MouseEvent(type,
+            Object.assign({}, init, {relatedTarget: relatedTarget, bubbles: bubbles, cancelable: bubbles})));
+        if (previous) {
+            transition(previous, 'mouseout', element, true);
+            // from the previous target up to the first common ancestor
+            for (const node of left.filter((node) => entered.indexOf(node) < 0)) {
+                transition(node, 'mouseleave', element, false);
+            }
+        }
+        transition(element, 'mouseover', previous, true);
+        // from the outermost new ancestor down to the target
+        for (const node of entered.filter((node) => left.indexOf(node) < 0).reverse()) {
+            transition(node, 'mouseenter', previous, false);
+        }
+    };
+    const createTouch = (point, target) => {
+        const init = {
+            identifier: point.id, target: target,
+            clientX: point.clientX, clientY: point.clientY,
+            screenX: point.x, screenY: point.y,
+            pageX: point.clientX + window.pageXOffset, pageY: point.clientY + window.pageYOffset,
+            radiusX: point.radiusX, radiusY: point.radiusY,
+            rotationAngle: point.rotationAngle, force: point.force
+        };
+        if (typeof Touch === 'function') {
+            try {
+                return new Touch(init);
+            } catch (e) {
+            }
+        }
+        return document.createTouch(window, target, point.id, init.pageX, init.pageY, init.screenX, init.screenY);
+    };
+    const createTouchList = (touches) => {
+        if (document.createTouchList) {
+            return document.createTouchList.apply(document, touches);
+        }
+        return touches;
+    };
+    const dispatchTouch = (type, target, touches, targetTouches, changedTouches) => {
+        let event;
+        try {
+            event = new TouchEvent(type, Object.assign({
+                bubbles: true, cancelable: type !== 'touchcancel', view: window,
+                touches: touches, targetTouches: targetTouches, changedTouches: changedTouches
+            }, keyState));
+        } catch (e) {
+            // iOS only has the legacy initializer
+            const first = changedTouches[0];
+            event = document.createEvent('TouchEvent');
+            event.initTouchEvent(type, true, type !== 'touchcancel', window, 0,
+                first.screenX, first.screenY, first.clientX, first.clientY,
+                keyState.ctrlKey, keyState.altKey, keyState.shiftKey, keyState.metaKey,
+                createTouchList(touches), createTouchList(targetTouches), createTouchList(changedTouches), 1, 0);
+        }
+        return target.dispatchEvent(event);
+    };
+
+    switch (command.kind) {
+    case 'mouse': {
+        const point = toClient(command.x, command.y);
+        const element = document.elementFromPoint(point.x, point.y);
+        if (!element) {
+            return false;
+        }
+        const init = Object.assign({
+            screenX: command.x, screenY: command.y,
+            clientX: point.x, clientY: point.y,
+            button: command.button, buttons: command.buttons, detail: command.clickCount,
+            bubbles: true, cancelable: true, view: window
+        }, keyState);
+        hover(element, init);
+        dispatchMouse(element, command.types, init);
+        return true;
+    }
+    case 'touch': {
+        const state = window.__sonicTouches || (window.__sonicTouches = {active: {}, moved: false});
+        const ids = {};
+        const started = [];
+        const moved = [];
+        const updating = command.type === 'touchStart' || command.type === 'touchMove';
+        for (const point of command.touchPoints) {
+            ids[point.id] = true;
+            if (!updating) {
+                continue;
+            }
+            const client = toClient(point.x, point.y);
+            point.clientX = client.x;
+            point.clientY = client.y;
+            const active = state.active[point.id];
+            if (!active) {
+                const target = document.elementFromPoint(client.x, client.y) || document.body;
+                state.active[point.id] = {point: point, target: target};
+                started.push(String(point.id));
+            } else if (active.point.clientX !== client.x || active.point.clientY !== client.y) {
+                active.point = point;
+                moved.push(String(point.id));
+            }
+        }
+        // touchEnd and touchCancel end every touch they do not list
+        const ended = updating ? [] : Object.keys(state.active).filter((id) => !ids[id]);
+        const touchOf = (id) => createTouch(state.active[id].point, state.active[id].target);
+        const activeIds = Object.keys(state.active);
+        // one event per target, touches lists every touch still on the surface
+        const fire = (type, changedIds, touchIds) => {
+            let accepted = true;
+            const targets = [];
+            for (const id of changedIds) {
+                if (targets.indexOf(state.active[id].target) < 0) {
+                    targets.push(state.active[id].target);
+                }
+            }
+            for (const target of targets) {
+                const changed = changedIds.filter((id) => state.active[id].target === target);
+                const targetTouches = touchIds.filter((id) => state.active[id].target === target);
+                accepted = dispatchTouch(type, target, touchIds.map(touchOf), targetTouches.map(touchOf), changed.map(touchOf)) && accepted;
+            }
+            return accepted;
+        };
+        let accepted = true;
+        if (started.length > 0) {
+            state.moved = false;
+            accepted = fire('touchstart', started, activeIds) && accepted;
+            state.startAccepted = accepted;
+        }
+        if (moved.length > 0) {
+            state.moved = true;
+            accepted = fire('touchmove', moved, activeIds) && accepted;
+        }
+        if (ended.length > 0) {
+            const remaining = activeIds.filter((id) => ended.indexOf(id) < 0);
+            const type = command.type === 'touchCancel' ? 'touchcancel' : 'touchend';
+            accepted = fire(type, ended, remaining) && accepted;
+            const last = state.active[ended[0]];
+            const tap = type === 'touchend' && !state.moved && state.startAccepted && accepted && remaining.length === 0;
+            for (const id of ended) {
+                delete state.active[id];
+            }
+            if (tap) {
+                // compatibility mouse events of a tap, as the browser does for real touches
+                const init = Object.assign({
+                    screenX: last.point.x, screenY: last.point.y,
+                    clientX: last.point.clientX, clientY: last.point.clientY,
+                    button: 0, detail: 1, bubbles: true, cancelable: true, view: window
+                }, keyState);
+                hover(last.target, init);
+                dispatchMouse(last.target, ['mousemove', 'mousedown', 'mouseup', 'click'], init);
+            }
+        }
+        return accepted;
+    }
+    case 'key': {
+        const target = document.activeElement || document.body;
+        const keyEvent = (type) => {
+            const event = new KeyboardEvent(type, Object.assign({
+                key: command.key, code: command.code, location: command.location,
+                repeat: command.autoRepeat, bubbles: true, cancelable: true, view: window
+            }, keyState));
+            // the constructor ignores the legacy codes that many pages still read
+            const keyCode = type === 'keypress' ? (command.text ? command.text.charCodeAt(0) : 0) : command.keyCode;
+            Object.defineProperty(event, 'keyCode', {get: () => keyCode});
+            Object.defineProperty(event, 'which', {get: () => keyCode});
+            Object.defineProperty(event, 'charCode', {get: () => type === 'keypress' ? keyCode : 0});
+            return target.dispatchEvent(event);
+        };
+        if (command.type === 'keyUp') {
+            keyEvent('keyup');
+            return true;
+        }
+        if (command.type !== 'char' && !keyEvent('keydown')) {
+            return true;
+        }
+        if (command.type === 'rawKeyDown') {
+            if (command.key === 'Backspace' || command.key === 'Delete') {
+                editText(command.key === 'Delete' ? 'deleteContentForward' : 'deleteContentBackward', undefined, command.key === 'Delete');
+            }
+            return true;
+        }
+        if (!command.text || !keyEvent('keypress')) {
+            return true;
+        }
+        if (command.text === '\r') {
+            const element = document.activeElement;
+            if (element && element.tagName === 'INPUT' && element.form) {
+                // implicit submission
+                if (element.form.requestSubmit) {
+                    element.form.requestSubmit();
+                } else {
+                    element.form.submit();
+                }
+                return true;
+            }
+            if (element && element.tagName === 'TEXTAREA') {
+                editText('insertLineBreak', '\n');
+            } else if (element && element.isContentEditable) {
+                document.execCommand('insertParagraph');
+            }
+            return true;
+        }
+        editText('insertText', command.text);
+        return true;
+    }
+    case 'insertText':
+        return editText('insertText', command.text);
+    case 'scroll': {
+        const point = toClient(command.x, command.y);
+        scrollFrom(document.elementFromPoint(point.x, point.y) || document.body, command.deltaX, command.deltaY);
+        return true;
+    }
+    }
+    return false;
+}`
+
+// dispatchInput runs inputShim with command and replies to the tool once the events are dispatched
+func (p *protocolAdapter) dispatchInput(id int, command map[string]interface{}) {
+	expression, err := inputExpression(command)
+	if err != nil {
+		log.Println(e.Convert(err).ToStr())
+		p.adapter.FireErrorToTools(id, serverErrorCode, err.Error())
+		return
+	}
+	p.adapter.CallTarget("Runtime.evaluate", map[string]interface{}{
+		"expression":    expression,
+		"returnByValue": true,
+	}, func(result []byte) {
+		if gjson.Get(string(result), "wasThrown").Bool() {
+			log.Println("input: " + gjson.Get(string(result), "result.description").String())
+		}
+		p.adapter.FireResultToTools(id, map[string]interface{}{})
+	})
+}
+
+func inputExpression(command map[string]interface{}) (string, error) {
+	arguments, err := json.Marshal(command)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("(%s)(%s)", inputShim, arguments), nil
+}
+
+// mouseButtons maps the CDP button names to MouseEvent.button
+var mouseButtons = map[string]int{
+	"left":    0,
+	"middle":  1,
+	"right":   2,
+	"back":    3,
+	"forward": 4,
+}
+
+// mouseEventTypes returns the DOM events of a CDP mouse event type
+func mouseEventTypes(eventType string, button string, clickCount int64) []string {
+	switch eventType {
+	case "mousePressed":
+		if button == "right" {
+			return []string{"mousedown", "contextmenu"}
+		}
+		return []string{"mousedown"}
+	case "mouseReleased":
+		if button == "right" || button == "none" || button == "" {
+			return []string{"mouseup"}
+		}
+		if clickCount == 2 {
+			return []string{"mouseup", "click", "dblclick"}
+		}
+		return []string{"mouseup", "click"}
+	case "mouseMoved":
+		return []string{"mousemove"}
+	case "mouseWheel":
+		return []string{"wheel"}
+	}
+	return nil
+}
+
+func mouseCommand(params gjson.Result, types []string) map[string]interface{} {
+	clickCount := params.Get("clickCount").Int()
+	if clickCount < 1 {
+		clickCount = 1
+	}
+	return map[string]interface{}{
+		"kind":       "mouse",
+		"types":      types,
+		"modifiers":  params.Get("modifiers").Int(),
+		"button":     mouseButtons[params.Get("button").String()],
+		"buttons":    params.Get("buttons").Int(),
+		"clickCount": clickCount,
+		"deltaX":     params.Get("deltaX").Float(),
+		"deltaY":     params.Get("deltaY").Float(),
+	}
+}
+
+func (p *protocolAdapter) onDispatchMouseEvent(message []byte) []byte {
+	msg := string(message)
+	id := int(gjson.Get(msg, "id").Int())
+	params := gjson.Get(msg, "params")
+	types := mouseEventTypes(params.Get("type").String(), params.Get("button").String(), params.Get("clickCount").Int())
+	if types == nil {
+		p.adapter.FireErrorToTools(id, serverErrorCode, "Unknown mouse event type "+params.Get("type").String())
+		return nil
+	}
+	command := mouseCommand(params, types)
+	// CSS pixels relative to the visual viewport
+	command["x"] = params.Get("x").Float()
+	command["y"] = params.Get("y").Float()
+	command["visualViewport"] = true
+	p.dispatchInput(id, command)
+	return nil
+}
+
+func (p *protocolAdapter) onEmulateTouchFromMouseEvent(message []byte) []byte {
+	msg := string(message)
+	id := int(gjson.Get(msg, "id").Int())
+	params := gjson.Get(msg, "params")
+	types := mouseEventTypes(params.Get("type").String(), params.Get("button").String(), params.Get("clickCount").Int())
+	if types == nil {
+		log.Println(fmt.Sprintf("Unknown emulate mouse event name %s", params.Get("type")))
+		return p.adapter.ReplyWithEmpty(msg)
+	}
+	command := mouseCommand(params, types)
+	// DevTools sends coordinates in DIP of the screencast frame it shows
+	command["x"], command["y"] = p.screencastViewport().dipToClient(params.Get("x").Float(), params.Get("y").Float())
+	p.dispatchInput(id, command)
+	return nil
+}
+
+func (p *protocolAdapter) onDispatchTouchEvent(message []byte) []byte {
+	msg := string(message)
+	id := int(gjson.Get(msg, "id").Int())
+	params := gjson.Get(msg, "params")
+	eventType := params.Get("type").String()
+	switch eventType {
+	case "touchStart", "touchMove", "touchEnd", "touchCancel":
+	default:
+		p.adapter.FireErrorToTools(id, serverErrorCode, "Unknown touch event type "+eventType)
+		return nil
+	}
+	var touchPoints []map[string]interface{}
+	for index, point := range params.Get("touchPoints").Array() {
+		touchID := index
+		if point.Get("id").Exists() {
+			touchID = int(point.Get("id").Int())
+		}
+		force := 1.0
+		if point.Get("force").Exists() {
+			force = point.Get("force").Float()
+		}
+		radius := func(name string) float64 {
+			if point.Get(name).Exists() {
+				return point.Get(name).Float()
+			}
+			return 1
+		}
+		touchPoints = append(touchPoints, map[string]interface{}{
+			"id":            touchID,
+			"x":             point.Get("x").Float(),
+			"y":             point.Get("y").Float(),
+			"radiusX":       radius("radiusX"),
+			"radiusY":       radius("radiusY"),
+			"rotationAngle": point.Get("rotationAngle").Float(),
+			"force":         force,
+		})
+	}
+	if touchPoints == nil {
+		touchPoints = []map[string]interface{}{}
+	}
+	p.dispatchInput(id, map[string]interface{}{
+		"kind":           "touch",
+		"type":           eventType,
+		"touchPoints":    touchPoints,
+		"modifiers":      params.Get("modifiers").Int(),
+		"visualViewport": true,
+	})
+	return nil
+}
+
+func (p *protocolAdapter) onDispatchKeyEvent(message []byte) []byte {
+	msg := string(message)
+	id := int(gjson.Get(msg, "id").Int())
+	params := gjson.Get(msg, "params")
+	eventType := params.Get("type").String()
+	switch eventType {
+	case "keyDown", "rawKeyDown", "keyUp", "char":
+	default:
+		p.adapter.FireErrorToTools(id, serverErrorCode, "Unknown key event type "+eventType)
+		return nil
+	}
+	text := params.Get("text").String()
+	key := params.Get("key").String()
+	if key == "" {
+		key = text
+	}
+	p.dispatchInput(id, map[string]interface{}{
+		"kind":       "key",
+		"type":       eventType,
+		"key":        key,
+		"code":       params.Get("code").String(),
+		"text":       text,
+		"keyCode":    params.Get("windowsVirtualKeyCode").Int(),
+		"location":   params.Get("location").Int(),
+		"autoRepeat": params.Get("autoRepeat").Bool(),
+		"modifiers":  params.Get("modifiers").Int(),
+	})
+	return nil
+}
+
+func (p *protocolAdapter) onInsertText(message []byte) []byte {
+	msg := string(message)
+	p.dispatchInput(int(gjson.Get(msg, "id").Int()), map[string]interface{}{
+		"kind": "insertText",
+		"text": gjson.Get(msg, "params.text").String(),
+	})
+	return nil
+}
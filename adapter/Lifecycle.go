@@ -0,0 +1,414 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"github.com/tidwall/gjson"
+	"sync"
+	"time"
+)
+
+// quiet period used by Chrome before reporting networkIdle and networkAlmostIdle
+const networkQuietPeriod = 500 * time.Millisecond
+
+// requests still allowed in flight for networkAlmostIdle
+const almostIdleRequestCount = 2
+
+// frameContentLoaded settles once the document of the context it runs in is past DOMContentLoaded
+const frameContentLoaded = `new Promise(function(resolve) {
+    if (document.readyState !== 'loading') {
+        resolve();
+        return;
+    }
+    document.addEventListener('DOMContentLoaded', function() {
+        resolve();
+    }, {once: true});
+})`
+
+// WebKit Network events the adapter may receive while the tool did not enable the domain
+var networkEvents = []string{
+	"Network.requestServedFromMemoryCache",
+	"Network.responseReceived",
+	"Network.dataReceived",
+	"Network.webSocketCreated",
+	"Network.webSocketWillSendHandshakeRequest",
+	"Network.webSocketHandshakeResponseReceived",
+	"Network.webSocketClosed",
+	"Network.webSocketFrameReceived",
+	"Network.webSocketFrameError",
+	"Network.webSocketFrameSent",
+}
+
+// networkDomain tracks who needs the WebKit Network domain, the tool or the lifecycle events
+type networkDomain struct {
+	lock      sync.Mutex
+	tool      bool
+	lifecycle bool
+}
+
+// setEnabled records whether the tool or the lifecycle events need the domain, it tells whether the domain was
+// enabled before and whether it still has to be
+func (n *networkDomain) setEnabled(tool bool, enabled bool) (wasEnabled bool, needed bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	wasEnabled = n.tool || n.lifecycle
+	if tool {
+		n.tool = enabled
+	} else {
+		n.lifecycle = enabled
+	}
+	return wasEnabled, n.tool || n.lifecycle
+}
+
+func (n *networkDomain) toolEnabled() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.tool
+}
+
+type lifecycleRequest struct {
+	frameId  string
+	loaderId string
+}
+
+// quietTimer reports a network quiet period once per document
+type quietTimer struct {
+	timer *time.Timer
+	// bumped whenever the timer is armed or cancelled, so late callbacks are ignored
+	generation int
+	fired      bool
+}
+
+type frameLifecycle struct {
+	loaderId      string
+	contentLoaded bool
+	loaded        bool
+	idle          quietTimer
+	almostIdle    quietTimer
+}
+
+// lifecycleTracker synthesizes Page.lifecycleEvent, WebKit only reports DOMContentLoaded and load
+type lifecycleTracker struct {
+	lock        sync.Mutex
+	adapter     *Adapter
+	enabled     bool
+	mainFrameId string
+	frames      map[string]*frameLifecycle
+	requests    map[string]lifecycleRequest
+}
+
+func newLifecycleTracker(adapter *Adapter) *lifecycleTracker {
+	return &lifecycleTracker{
+		adapter:  adapter,
+		frames:   make(map[string]*frameLifecycle),
+		requests: make(map[string]lifecycleRequest),
+	}
+}
+
+func (l *lifecycleTracker) setEnabled(enabled bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.enabled = enabled
+}
+
+func (l *lifecycleTracker) frame(frameId string) *frameLifecycle {
+	frame, ok := l.frames[frameId]
+	if !ok {
+		frame = &frameLifecycle{}
+		l.frames[frameId] = frame
+	}
+	return frame
+}
+
+func (l *lifecycleTracker) frameNavigated(frameId string, loaderId string, isMainFrame bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if isMainFrame {
+		l.mainFrameId = frameId
+		// a new main document discards every child frame
+		for id, frame := range l.frames {
+			frame.stopTimers()
+			delete(l.frames, id)
+		}
+		for requestId, request := range l.requests {
+			if request.frameId != frameId {
+				delete(l.requests, requestId)
+			}
+		}
+	}
+	frame := l.frame(frameId)
+	frame.stopTimers()
+	*frame = frameLifecycle{loaderId: loaderId}
+	// requests of the previous document of this frame will never settle the new one
+	for requestId, request := range l.requests {
+		if request.frameId == frameId && request.loaderId != loaderId {
+			delete(l.requests, requestId)
+		}
+	}
+	l.fire(frameId, "init")
+}
+
+// domContentLoaded reports DOMContentLoaded once per document, loaderId is empty when the document is the current one
+func (l *lifecycleTracker) domContentLoaded(frameId string, loaderId string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if frameId == "" {
+		frameId = l.mainFrameId
+	}
+	frame, ok := l.frames[frameId]
+	if !ok || frame.contentLoaded || loaderId != "" && frame.loaderId != loaderId {
+		return
+	}
+	frame.contentLoaded = true
+	l.fire(frameId, "DOMContentLoaded")
+}
+
+// childDocument returns the document of a child frame, false when its lifecycle events are not needed
+func (l *lifecycleTracker) childDocument(frameId string) (string, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	frame, ok := l.frames[frameId]
+	if !l.enabled || !ok || frameId == l.mainFrameId || frame.contentLoaded {
+		return "", false
+	}
+	return frame.loaderId, true
+}
+
+func (l *lifecycleTracker) loaded(frameId string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if frameId == "" {
+		frameId = l.mainFrameId
+	}
+	frame, ok := l.frames[frameId]
+	if !ok || frame.loaded {
+		return
+	}
+	frame.loaded = true
+	l.fire(frameId, "load")
+	l.checkIdle(frameId)
+}
+
+func (l *lifecycleTracker) requestStarted(requestId string, frameId string, loaderId string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if frameId == "" {
+		frameId = l.mainFrameId
+	}
+	l.requests[requestId] = lifecycleRequest{frameId: frameId, loaderId: loaderId}
+	l.checkIdle(frameId)
+}
+
+func (l *lifecycleTracker) requestFinished(requestId string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	request, ok := l.requests[requestId]
+	if !ok {
+		return
+	}
+	delete(l.requests, requestId)
+	l.checkIdle(request.frameId)
+}
+
+func (l *lifecycleTracker) inflight(frameId string) int {
+	count := 0
+	for _, request := range l.requests {
+		if request.frameId == frameId {
+			count++
+		}
+	}
+	return count
+}
+
+// checkIdle (re)arms the quiet period timers of a loaded frame, callers hold the lock
+func (l *lifecycleTracker) checkIdle(frameId string) {
+	frame, ok := l.frames[frameId]
+	if !ok || !frame.loaded {
+		return
+	}
+	inflight := l.inflight(frameId)
+	l.updateQuietTimer(frameId, frame, &frame.almostIdle, inflight <= almostIdleRequestCount, "networkAlmostIdle")
+	l.updateQuietTimer(frameId, frame, &frame.idle, inflight == 0, "networkIdle")
+}
+
+func (l *lifecycleTracker) updateQuietTimer(frameId string, frame *frameLifecycle, quiet *quietTimer, isQuiet bool, name string) {
+	if quiet.fired {
+		return
+	}
+	if isQuiet && quiet.timer == nil {
+		quiet.generation++
+		generation := quiet.generation
+		loaderId := frame.loaderId
+		quiet.timer = time.AfterFunc(networkQuietPeriod, func() {
+			l.quietPeriodElapsed(frameId, loaderId, generation, name)
+		})
+	} else if !isQuiet && quiet.timer != nil {
+		quiet.timer.Stop()
+		quiet.timer = nil
+		quiet.generation++
+	}
+}
+
+func (l *lifecycleTracker) quietPeriodElapsed(frameId string, loaderId string, generation int, name string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	frame, ok := l.frames[frameId]
+	if !ok || frame.loaderId != loaderId {
+		return
+	}
+	quiet := &frame.almostIdle
+	if name == "networkIdle" {
+		quiet = &frame.idle
+	}
+	if quiet.fired || quiet.generation != generation {
+		return
+	}
+	quiet.fired = true
+	quiet.timer = nil
+	l.fire(frameId, name)
+}
+
+// fire sends the event when enabled, callers hold the lock
+func (l *lifecycleTracker) fire(frameId string, name string) {
+	if !l.enabled {
+		return
+	}
+	frame, ok := l.frames[frameId]
+	if !ok {
+		return
+	}
+	l.adapter.FireEventToTools("Page.lifecycleEvent", map[string]interface{}{
+		"frameId":   frameId,
+		"loaderId":  frame.loaderId,
+		"name":      name,
+		"timestamp": float64(time.Now().UnixNano()) / float64(time.Second),
+	})
+}
+
+func (f *frameLifecycle) stopTimers() {
+	if f.idle.timer != nil {
+		f.idle.timer.Stop()
+	}
+	if f.almostIdle.timer != nil {
+		f.almostIdle.timer.Stop()
+	}
+}
+
+// onSetLifecycleEventsEnabled enables the Network domain for the adapter, in-flight requests are only visible with
+// it. Its events only reach the tool once the tool enabled it too.
+func (p *protocolAdapter) onSetLifecycleEventsEnabled(message []byte) []byte {
+	enabled := gjson.Get(string(message), "params.enabled").Bool()
+	wasEnabled, needed := p.network.setEnabled(false, enabled)
+	if needed && !wasEnabled {
+		p.adapter.CallTarget("Network.enable", map[string]interface{}{}, p.defaultCallFunc)
+	} else if wasEnabled && !needed {
+		p.adapter.CallTarget("Network.disable", map[string]interface{}{}, p.defaultCallFunc)
+	}
+	p.lifecycle.setEnabled(enabled)
+	return p.adapter.ReplyWithEmpty(string(message))
+}
+
+func (p *protocolAdapter) onNetworkEnable(message []byte) []byte {
+	p.network.setEnabled(true, true)
+	return message
+}
+
+// onNetworkDisable keeps the domain enabled while the lifecycle events need it
+func (p *protocolAdapter) onNetworkDisable(message []byte) []byte {
+	if _, needed := p.network.setEnabled(true, false); needed {
+		return p.adapter.ReplyWithEmpty(string(message))
+	}
+	return message
+}
+
+// toolNetworkEvent drops the Network events the tool did not ask for
+func (p *protocolAdapter) toolNetworkEvent(message []byte) []byte {
+	if !p.network.toolEnabled() {
+		return nil
+	}
+	return message
+}
+
+// watchContentLoaded reports DOMContentLoaded for a child frame, WebKit only reports the one of the main frame.
+// It waits in the default context of the frame, so child frames only get it with the Runtime domain enabled.
+func (p *protocolAdapter) watchContentLoaded(frameId string, contextId int64) {
+	loaderId, ok := p.lifecycle.childDocument(frameId)
+	if !ok {
+		return
+	}
+	settled := func(result []byte) {
+		if !isWebkitError(result) && !gjson.GetBytes(result, "wasThrown").Bool() {
+			p.lifecycle.domContentLoaded(frameId, loaderId)
+		}
+	}
+	p.adapter.CallTarget("Runtime.evaluate", map[string]interface{}{
+		"expression":                           frameContentLoaded,
+		"contextId":                            contextId,
+		"doNotPauseOnExceptionsAndMuteConsole": true,
+	}, func(result []byte) {
+		promiseId := gjson.GetBytes(result, "result.objectId")
+		if isWebkitError(result) || gjson.GetBytes(result, "wasThrown").Bool() || !promiseId.Exists() {
+			return
+		}
+		if !p.runtime.nativeAwaitPromise {
+			p.awaitRemoteObject(promiseId.String(), false, false, settled)
+			return
+		}
+		p.adapter.CallTarget("Runtime.awaitPromise", map[string]interface{}{
+			"promiseObjectId": promiseId.String(),
+		}, settled)
+	})
+}
+
+func (p *protocolAdapter) onFrameStoppedLoading(message []byte) []byte {
+	frameId := gjson.Get(string(message), "params.frameId").String()
+	mainFrameId, _ := p.navigation.mainFrame()
+	// the main frame load is reported by Page.loadEventFired
+	if frameId != mainFrameId {
+		p.lifecycle.loaded(frameId)
+	}
+	p.navigationStopped(frameId)
+	return message
+}
+
+func (p *protocolAdapter) onLoadEventFired(message []byte) []byte {
+	p.lifecycle.loaded("")
+	return message
+}
+
+func (p *protocolAdapter) onNetworkRequestWillBeSent(message []byte) []byte {
+	params := gjson.Get(string(message), "params")
+	p.lifecycle.requestStarted(params.Get("requestId").String(), params.Get("frameId").String(), params.Get("loaderId").String())
+	switch params.Get("type").String() {
+	case "Document":
+		p.navigation.documentRequested(params.Get("requestId").String(), params.Get("frameId").String())
+	case "Script":
+		p.executionContexts.setResourceFrame(params.Get("request.url").String(), params.Get("frameId").String())
+	}
+	return p.toolNetworkEvent(message)
+}
+
+func (p *protocolAdapter) onNetworkLoadingFinished(message []byte) []byte {
+	p.lifecycle.requestFinished(gjson.Get(string(message), "params.requestId").String())
+	return p.toolNetworkEvent(message)
+}
+
+func (p *protocolAdapter) onNetworkLoadingFailed(message []byte) []byte {
+	params := gjson.Get(string(message), "params")
+	p.navigationFailed(params.Get("requestId").String(), params.Get("errorText").String())
+	return p.onNetworkLoadingFinished(message)
+}
@@ -0,0 +1,429 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"fmt"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/yezihack/e"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// navigateTimeout bounds the wait of Page.navigate for a main frame commit
+const navigateTimeout = 30 * time.Second
+
+type navigationEntry struct {
+	ID             int    `json:"id"`
+	Url            string `json:"url"`
+	UserTypedURL   string `json:"userTypedURL"`
+	Title          string `json:"title"`
+	TransitionType string `json:"transitionType"`
+}
+
+// navigationHistory mirrors the main frame history, WebKit has no command to read it
+type navigationHistory struct {
+	lock         sync.Mutex
+	entries      []navigationEntry
+	currentIndex int
+	nextID       int
+	// index requested by navigateToHistoryEntry, -1 when none is in flight
+	pendingIndex int
+	// url and transition of the next navigation started by the adapter
+	pendingTypedURL   string
+	pendingTransition string
+	mainFrameId       string
+	mainLoaderId      string
+	// scriptToEvaluateOnLoad of the last Page.reload, WebKit has no such parameter
+	scriptOnLoad string
+	// ids of the Page.navigate requests answered once the main frame commits, with the loaderId of its document
+	pendingNavigations []int
+	// the request of the main document loading for them, its failure answers them
+	navigationRequestId string
+}
+
+func newNavigationHistory() *navigationHistory {
+	return &navigationHistory{
+		pendingIndex: -1,
+	}
+}
+
+// committed records a main frame navigation
+func (n *navigationHistory) committed(frameId string, loaderId string, url string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.mainFrameId = frameId
+	n.mainLoaderId = loaderId
+	n.navigationRequestId = ""
+
+	transition := n.pendingTransition
+	typedURL := n.pendingTypedURL
+	n.pendingTransition = ""
+	n.pendingTypedURL = ""
+
+	if n.pendingIndex >= 0 && n.pendingIndex < len(n.entries) {
+		n.currentIndex = n.pendingIndex
+		n.pendingIndex = -1
+		n.entries[n.currentIndex].Url = url
+		return
+	}
+	n.pendingIndex = -1
+
+	if len(n.entries) > 0 && n.entries[n.currentIndex].Url == url {
+		// reload or same document navigation
+		if transition == "" {
+			transition = "reload"
+		}
+		n.entries[n.currentIndex].TransitionType = transition
+		return
+	}
+	if transition == "" {
+		// WebKit does not tell a history move of the page from a link to the same url, both add an entry
+		transition = "link"
+	}
+	if typedURL == "" {
+		typedURL = url
+	}
+	if len(n.entries) > 0 {
+		// navigating away drops the forward entries, like the browser does
+		n.entries = n.entries[:n.currentIndex+1]
+	}
+	n.entries = append(n.entries, navigationEntry{
+		ID:             n.nextID,
+		Url:            url,
+		UserTypedURL:   typedURL,
+		TransitionType: transition,
+	})
+	n.nextID++
+	n.currentIndex = len(n.entries) - 1
+}
+
+// ensureCurrent seeds the history when the tool attached after the last navigation
+func (n *navigationHistory) ensureCurrent(url string, title string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if len(n.entries) == 0 {
+		n.entries = append(n.entries, navigationEntry{
+			ID:             n.nextID,
+			Url:            url,
+			UserTypedURL:   url,
+			TransitionType: "typed",
+		})
+		n.nextID++
+		n.currentIndex = 0
+	}
+	n.entries[n.currentIndex].Title = title
+}
+
+func (n *navigationHistory) snapshot() (int, []navigationEntry) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	entries := make([]navigationEntry, len(n.entries))
+	copy(entries, n.entries)
+	return n.currentIndex, entries
+}
+
+// delta returns the history.go offset to reach entryId
+func (n *navigationHistory) delta(entryId int) (int, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for index, entry := range n.entries {
+		if entry.ID == entryId {
+			if index != n.currentIndex {
+				n.pendingIndex = index
+				n.pendingTransition = "auto_bookmark"
+			}
+			return index - n.currentIndex, true
+		}
+	}
+	return 0, false
+}
+
+func (n *navigationHistory) expect(typedURL string, transition string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.pendingTypedURL = typedURL
+	n.pendingTransition = transition
+}
+
+func (n *navigationHistory) reset() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if len(n.entries) == 0 {
+		return
+	}
+	n.entries = []navigationEntry{n.entries[n.currentIndex]}
+	n.currentIndex = 0
+	n.pendingIndex = -1
+}
+
+func (n *navigationHistory) setScriptOnLoad(script string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.scriptOnLoad = script
+}
+
+func (n *navigationHistory) takeScriptOnLoad() string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	script := n.scriptOnLoad
+	n.scriptOnLoad = ""
+	return script
+}
+
+// awaitCommit holds the reply to a Page.navigate until the next main frame commit
+func (n *navigationHistory) awaitCommit(id int) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.pendingNavigations = append(n.pendingNavigations, id)
+}
+
+// cancelCommit drops a Page.navigate that failed before loading anything
+func (n *navigationHistory) cancelCommit(id int) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for index, pending := range n.pendingNavigations {
+		if pending == id {
+			n.pendingNavigations = append(n.pendingNavigations[:index], n.pendingNavigations[index+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// takeNavigations returns the Page.navigate requests waiting for a commit
+func (n *navigationHistory) takeNavigations() []int {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	ids := n.pendingNavigations
+	n.pendingNavigations = nil
+	n.navigationRequestId = ""
+	return ids
+}
+
+// documentRequested remembers the main document request of the pending navigations
+func (n *navigationHistory) documentRequested(requestId string, frameId string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if len(n.pendingNavigations) > 0 && (n.mainFrameId == "" || frameId == n.mainFrameId) {
+		n.navigationRequestId = requestId
+	}
+}
+
+// documentFailed returns the Page.navigate requests whose document request failed
+func (n *navigationHistory) documentFailed(requestId string) []int {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if requestId == "" || requestId != n.navigationRequestId {
+		return nil
+	}
+	ids := n.pendingNavigations
+	n.pendingNavigations = nil
+	n.navigationRequestId = ""
+	return ids
+}
+
+// documentStopped returns the Page.navigate requests whose document was requested but the main frame stopped
+// loading without a commit, a download or a response without content
+func (n *navigationHistory) documentStopped(frameId string) []int {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.navigationRequestId == "" || (n.mainFrameId != "" && frameId != n.mainFrameId) {
+		return nil
+	}
+	ids := n.pendingNavigations
+	n.pendingNavigations = nil
+	n.navigationRequestId = ""
+	return ids
+}
+
+// sameDocument tells whether url only changes the fragment of the current entry, no new document is loaded then
+func (n *navigationHistory) sameDocument(url string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if len(n.entries) == 0 || !strings.Contains(url, "#") {
+		return false
+	}
+	current := n.entries[n.currentIndex].Url
+	return strings.SplitN(current, "#", 2)[0] == strings.SplitN(url, "#", 2)[0]
+}
+
+func (n *navigationHistory) mainFrame() (string, string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.mainFrameId, n.mainLoaderId
+}
+
+func (p *protocolAdapter) onGetNavigationHistory(message []byte) []byte {
+	var id = int(gjson.Get(string(message), "id").Int())
+	params := map[string]interface{}{
+		"expression":    "({url: window.location.href, title: document.title})",
+		"returnByValue": true,
+	}
+	p.adapter.CallTarget("Runtime.evaluate", params, func(result []byte) {
+		value := gjson.Get(string(result), "result.value")
+		if value.Exists() {
+			p.navigation.ensureCurrent(value.Get("url").String(), value.Get("title").String())
+		}
+		currentIndex, entries := p.navigation.snapshot()
+		p.adapter.FireResultToTools(id, map[string]interface{}{
+			"currentIndex": currentIndex,
+			"entries":      entries,
+		})
+	})
+	return nil
+}
+
+func (p *protocolAdapter) onNavigateToHistoryEntry(message []byte) []byte {
+	var id = int(gjson.Get(string(message), "id").Int())
+	delta, ok := p.navigation.delta(int(gjson.Get(string(message), "params.entryId").Int()))
+	if !ok {
+		p.adapter.FireErrorToTools(id, serverErrorCode, "No entry with passed id")
+		return nil
+	}
+	if delta != 0 {
+		p.adapter.CallTarget("Runtime.evaluate", map[string]interface{}{
+			"expression": fmt.Sprintf("window.history.go(%d)", delta),
+		}, p.defaultCallFunc)
+	}
+	p.adapter.FireResultToTools(id, map[string]interface{}{})
+	return nil
+}
+
+func (p *protocolAdapter) onResetNavigationHistory(message []byte) []byte {
+	p.navigation.reset()
+	return p.adapter.ReplyWithEmpty(string(message))
+}
+
+func (p *protocolAdapter) onPageReload(message []byte) []byte {
+	msg := string(message)
+	var err error
+	// the script runs once the new document is ready
+	script := gjson.Get(msg, "params.scriptToEvaluateOnLoad")
+	if script.Exists() {
+		p.navigation.setScriptOnLoad(script.String())
+		msg, err = sjson.Delete(msg, "params.scriptToEvaluateOnLoad")
+		if err != nil {
+			log.Println(e.Convert(err).ToStr())
+		}
+	}
+	p.navigation.expect("", "reload")
+	return []byte(msg)
+}
+
+func (p *protocolAdapter) evaluateScriptOnLoad() {
+	script := p.navigation.takeScriptOnLoad()
+	if script == "" {
+		return
+	}
+	p.adapter.CallTarget("Runtime.evaluate", map[string]interface{}{
+		"expression": script,
+	}, p.defaultCallFunc)
+}
+
+func (p *protocolAdapter) onStopLoading(message []byte) []byte {
+	// WebKit has no Page.stopLoading
+	p.adapter.CallTarget("Runtime.evaluate", map[string]interface{}{
+		"expression": "window.stop()",
+	}, p.defaultCallFunc)
+	return p.adapter.ReplyWithEmpty(string(message))
+}
+
+// onPageNavigate answers once the main frame committed the new document, with its loaderId.
+// Without loaderId a client waits for a same document navigation.
+func (p *protocolAdapter) onPageNavigate(message []byte) []byte {
+	msg := string(message)
+	id := int(gjson.Get(msg, "id").Int())
+	url := gjson.Get(msg, "params.url").String()
+	frameId := gjson.Get(msg, "params.frameId")
+	mainFrameId, _ := p.navigation.mainFrame()
+	if frameId.Exists() && mainFrameId != "" && frameId.String() != mainFrameId {
+		p.adapter.FireErrorToTools(id, serverErrorCode, "Navigating child frames is not supported")
+		return nil
+	}
+	transitionType := gjson.Get(msg, "params.transitionType").String()
+	if transitionType == "" {
+		transitionType = "typed"
+	}
+	p.navigation.expect(url, transitionType)
+	sameDocument := p.navigation.sameDocument(url)
+	if !sameDocument {
+		// WebKit may report the commit before its reply
+		p.navigation.awaitCommit(id)
+		// a blocked url neither commits nor stops a load
+		time.AfterFunc(navigateTimeout, func() {
+			if p.navigation.cancelCommit(id) {
+				p.replyNavigate(id, "", "net::ERR_TIMED_OUT")
+			}
+		})
+	}
+
+	// referrer, transitionType and frameId have no WebKit counterpart
+	p.adapter.CallTarget("Page.navigate", map[string]interface{}{
+		"url": url,
+	}, func(result []byte) {
+		if isWebkitError(result) {
+			if sameDocument || p.navigation.cancelCommit(id) {
+				p.replyNavigate(id, "", gjson.GetBytes(result, "message").String())
+			}
+			return
+		}
+		if sameDocument {
+			p.replyNavigate(id, "", "")
+		}
+	})
+	return nil
+}
+
+// replyNavigate answers Page.navigate with the navigated frame, errorText tells why nothing was loaded
+func (p *protocolAdapter) replyNavigate(id int, loaderId string, errorText string) {
+	mainFrameId, _ := p.navigation.mainFrame()
+	result := map[string]interface{}{
+		"frameId": mainFrameId,
+	}
+	if loaderId != "" {
+		result["loaderId"] = loaderId
+	}
+	if errorText != "" {
+		result["errorText"] = errorText
+	}
+	p.adapter.FireResultToTools(id, result)
+}
+
+// navigationCommitted answers the Page.navigate requests waiting for the main frame
+func (p *protocolAdapter) navigationCommitted(loaderId string) {
+	for _, id := range p.navigation.takeNavigations() {
+		p.replyNavigate(id, loaderId, "")
+	}
+}
+
+// navigationStopped answers the Page.navigate requests whose main frame stopped loading without a new document
+func (p *protocolAdapter) navigationStopped(frameId string) {
+	for _, id := range p.navigation.documentStopped(frameId) {
+		p.replyNavigate(id, "", "net::ERR_ABORTED")
+	}
+}
+
+// navigationFailed answers the Page.navigate requests whose document could not be loaded
+func (p *protocolAdapter) navigationFailed(requestId string, errorText string) {
+	for _, id := range p.navigation.documentFailed(requestId) {
+		p.replyNavigate(id, "", errorText)
+	}
+}
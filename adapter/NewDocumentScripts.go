@@ -0,0 +1,273 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"github.com/yezihack/e"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type newDocumentScript struct {
+	identifier string
+	source     string
+	// the bootstrap script leaves out a script until Runtime.parse checked it
+	checked     bool
+	syntaxError string
+}
+
+// newDocumentScripts is the registry behind Page.addScriptToEvaluateOnNewDocument,
+// WebKit only keeps one bootstrap script so the registry is installed as a whole
+type newDocumentScripts struct {
+	lock sync.Mutex
+	// Page.setBootstrapScript is available on this iOS version, set by initProtocolAdapter
+	native         bool
+	nextIdentifier int
+	scripts        []newDocumentScript
+}
+
+func newNewDocumentScripts() *newDocumentScripts {
+	return &newDocumentScripts{
+		nextIdentifier: 1,
+	}
+}
+
+func (n *newDocumentScripts) add(source string) string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	identifier := strconv.Itoa(n.nextIdentifier)
+	n.nextIdentifier++
+	n.scripts = append(n.scripts, newDocumentScript{identifier: identifier, source: source})
+	return identifier
+}
+
+func (n *newDocumentScripts) setChecked(identifier string, syntaxError string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for index, script := range n.scripts {
+		if script.identifier == identifier {
+			n.scripts[index].checked = true
+			n.scripts[index].syntaxError = syntaxError
+			return true
+		}
+	}
+	return false
+}
+
+func (n *newDocumentScripts) remove(identifier string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for index, script := range n.scripts {
+		if script.identifier == identifier {
+			n.scripts = append(n.scripts[:index], n.scripts[index+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (n *newDocumentScripts) list() []newDocumentScript {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	scripts := make([]newDocumentScript, len(n.scripts))
+	copy(scripts, n.scripts)
+	return scripts
+}
+
+// isolateScript wraps source in a block of its own so that its runtime errors do not stop the scripts after it.
+// No eval is involved, a content security policy of the page applies to the bootstrap script already. The source
+// must be free of syntax errors, the top level let, const and class of a script are only visible in its block.
+func isolateScript(label string, source string) string {
+	quotedLabel, _ := json.Marshal(label)
+	return fmt.Sprintf("try {\n%s\n} catch (e) {\n    console.error(%s, e);\n}\n", source, quotedLabel)
+}
+
+// rejectedScript stands for a script with a syntax error in the bootstrap script, the error is logged instead
+func rejectedScript(label string, syntaxError string) string {
+	quotedLabel, _ := json.Marshal(label)
+	quotedError, _ := json.Marshal(syntaxError)
+	return fmt.Sprintf("console.error(%s, new SyntaxError(%s));\n", quotedLabel, quotedError)
+}
+
+// bootstrapScript is the runtime shims with the bindings and the emulation overrides followed by the registered
+// scripts in their order
+func (p *protocolAdapter) bootstrapScript() string {
+	var builder strings.Builder
+	builder.WriteString(isolateScript("Runtime shims failed:", p.pageChannel.shim()+bindingScript(p.bindings.persistent())))
+	if p.emulation.active() {
+		arguments, err := json.Marshal(p.emulation.state())
+		if err != nil {
+			log.Println(e.Convert(err).ToStr())
+		} else {
+			builder.WriteString(isolateScript("Emulation overrides failed:", fmt.Sprintf("(%s)(%s)", emulationShim, arguments)))
+		}
+	}
+	for _, script := range p.newDocumentScripts.list() {
+		label := "Script " + script.identifier + " evaluated on new document failed:"
+		switch {
+		case !script.checked:
+		case script.syntaxError != "":
+			builder.WriteString(rejectedScript(label, script.syntaxError))
+		default:
+			builder.WriteString(isolateScript(label, script.source))
+		}
+	}
+	return builder.String()
+}
+
+// installBootstrapScript hands the current bootstrap script to WebKit, it runs before the scripts of every new document
+func (p *protocolAdapter) installBootstrapScript() {
+	if !p.newDocumentScripts.native {
+		return
+	}
+	p.adapter.CallTarget("Page.setBootstrapScript", map[string]interface{}{
+		"source": p.bootstrapScript(),
+	}, func(result []byte) {
+		if isWebkitError(result) {
+			log.Println("Page.setBootstrapScript: " + gjson.GetBytes(result, "message").String())
+		}
+	})
+}
+
+// onTargetCreated installs the bootstrap script and the emulated media again, a new target starts without them.
+// The contexts of the previous target are gone with it.
+func (p *protocolAdapter) onTargetCreated() {
+	p.clearExecutionContexts()
+	p.collectionEntries.clear()
+	p.compiledScripts.clear()
+	p.globalScripts.clear()
+	p.installBootstrapScript()
+	if p.console.enabled() {
+		p.adapter.CallTarget("Console.enable", map[string]interface{}{}, p.defaultCallFunc)
+	}
+	if p.emulatedMedia.active() {
+		p.applyEmulatedMedia("", nil)
+	}
+}
+
+// evaluateNewDocumentScripts runs the registered scripts once the document is loaded,
+// the late fallback of WebKit versions without bootstrap script
+func (p *protocolAdapter) evaluateNewDocumentScripts() {
+	for _, script := range p.newDocumentScripts.list() {
+		p.evaluateNewDocumentScript(script.identifier, script.source)
+	}
+}
+
+// evaluateNewDocumentScript runs source as a script of its own, its errors cannot reach the other scripts
+func (p *protocolAdapter) evaluateNewDocumentScript(identifier string, source string) {
+	p.adapter.CallTarget("Runtime.evaluate", map[string]interface{}{
+		"expression": source,
+	}, func(result []byte) {
+		if isWebkitError(result) {
+			log.Println("Script " + identifier + " evaluated on new document failed: " + gjson.GetBytes(result, "message").String())
+		} else if gjson.GetBytes(result, "wasThrown").Bool() {
+			log.Println("Script " + identifier + " evaluated on new document failed: " + gjson.GetBytes(result, "result.description").String())
+		}
+	})
+}
+
+// checkNewDocumentScript asks WebKit for the syntax errors of a registered script, then installs the bootstrap
+// script with it and calls done. Targets without Runtime.parse check the script with syntaxCheck instead.
+func (p *protocolAdapter) checkNewDocumentScript(identifier string, source string, done func()) {
+	checked := func(syntaxError string) {
+		if p.newDocumentScripts.setChecked(identifier, syntaxError) {
+			p.installBootstrapScript()
+		}
+		done()
+	}
+	p.adapter.CallTarget("Runtime.parse", map[string]interface{}{
+		"source": source,
+	}, func(result []byte) {
+		if isWebkitError(result) {
+			p.syntaxCheckNewDocumentScript(source, checked)
+			return
+		}
+		syntaxError := ""
+		if gjson.GetBytes(result, "result").String() != "none" {
+			syntaxError = gjson.GetBytes(result, "message").String()
+		}
+		checked(syntaxError)
+	})
+}
+
+// syntaxCheckNewDocumentScript is the fallback of checkNewDocumentScript, a failing evaluation leaves the
+// script unchecked rather than dropping it
+func (p *protocolAdapter) syntaxCheckNewDocumentScript(source string, checked func(syntaxError string)) {
+	quotedSource, err := json.Marshal(source)
+	if err != nil {
+		log.Println(e.Convert(err).ToStr())
+		checked("")
+		return
+	}
+	p.adapter.CallTarget("Runtime.evaluate", map[string]interface{}{
+		"expression":                           syntaxCheck + "(" + string(quotedSource) + ")",
+		"returnByValue":                        true,
+		"doNotPauseOnExceptionsAndMuteConsole": true,
+	}, func(result []byte) {
+		if isWebkitError(result) {
+			checked("")
+			return
+		}
+		checked(gjson.GetBytes(result, "result.value.message").String())
+	})
+}
+
+// onAddScriptToEvaluateOnNewDocument also serves the deprecated Page.addScriptToEvaluateOnLoad
+func (p *protocolAdapter) onAddScriptToEvaluateOnNewDocument(message []byte) []byte {
+	msg := string(message)
+	params := gjson.Get(msg, "params")
+	source := params.Get("source").String()
+	if !params.Get("source").Exists() {
+		source = params.Get("scriptSource").String()
+	}
+	if params.Get("worldName").String() != "" {
+		p.warnTool("Page.addScriptToEvaluateOnNewDocument: isolated worlds are not supported, the script runs in the page world")
+	}
+	identifier := p.newDocumentScripts.add(source)
+	if !p.newDocumentScripts.native {
+		p.warnTool("Page.addScriptToEvaluateOnNewDocument: this iOS version has no bootstrap script, the script runs once the document is loaded")
+	}
+	if params.Get("runImmediately").Bool() {
+		p.evaluateNewDocumentScript(identifier, source)
+	}
+	// the reply waits for the bootstrap script with the script, a navigation sent after it runs the script
+	p.checkNewDocumentScript(identifier, source, func() {
+		p.adapter.FireResultToTools(int(gjson.Get(msg, "id").Int()), map[string]interface{}{
+			"identifier": identifier,
+		})
+	})
+	return nil
+}
+
+// onRemoveScriptToEvaluateOnNewDocument also serves the deprecated Page.removeScriptToEvaluateOnLoad
+func (p *protocolAdapter) onRemoveScriptToEvaluateOnNewDocument(message []byte) []byte {
+	msg := string(message)
+	id := int(gjson.Get(msg, "id").Int())
+	identifier := gjson.Get(msg, "params.identifier").String()
+	if !p.newDocumentScripts.remove(identifier) {
+		p.adapter.FireErrorToTools(id, serverErrorCode, "Script not found")
+		return nil
+	}
+	p.installBootstrapScript()
+	p.adapter.FireResultToTools(id, map[string]interface{}{})
+	return nil
+}
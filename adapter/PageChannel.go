@@ -0,0 +1,227 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/tidwall/gjson"
+	"github.com/yezihack/e"
+	"log"
+	"strings"
+	"sync"
+)
+
+// pageChannelMarker starts the first argument of the console messages runtimeShim sends to the adapter,
+// they are consumed here and never reach the tool. The rest of the argument is the secret of the session, a page
+// logging the marker cannot pass for the shim. Their last argument is a sequence number.
+const pageChannelMarker = "__sonicPageChannel"
+
+// runtimeShim reports what WebKit does not tell the inspector: the rejections handled after being reported and the
+// calls of the bindings. A rejection is announced once the event could be canceled, WebKit logs the same ones in
+// the same order. The shim keeps what it calls before the page can replace it, a document still running the shim of
+// a previous session gets the one of the new session.
+const runtimeShim = `(function(marker, session) {
+    if (window.__sonicRuntimeShim === session) {
+        return;
+    }
+    Object.defineProperty(window, '__sonicRuntimeShim', {
+        configurable: true,
+        value: session
+    });
+    const debug = console.debug;
+    const apply = Reflect.apply;
+    // WebKit only counts identical consecutive messages, the sequence number keeps every message apart
+    let sequence = 0;
+    const send = function(kind, first, second, third) {
+        sequence++;
+        apply(debug, console, [marker, kind, first, second, third, sequence]);
+    };
+    Object.defineProperty(window, '__sonicAddBinding', {
+        configurable: true,
+        value: function(name, contextId) {
+            Object.defineProperty(window, name, {
+                configurable: true,
+                writable: true,
+                value: function(payload) {
+                    if (arguments.length !== 1 || typeof payload !== 'string') {
+                        throw new TypeError('Invalid arguments: should be exactly one string.');
+                    }
+                    // a binding of the bootstrap script tells its document, the adapter finds the frame with it
+                    send('binding', name, payload, contextId === undefined ? location.href : contextId);
+                }
+            });
+        }
+    });
+    const rejections = new WeakMap();
+    let nextRejection = 0;
+    window.addEventListener('unhandledrejection', function(event) {
+        setTimeout(function() {
+            if (event.defaultPrevented) {
+                return;
+            }
+            nextRejection++;
+            rejections.set(event.promise, nextRejection);
+            send('rejection', nextRejection);
+        }, 0);
+    });
+    window.addEventListener('rejectionhandled', function(event) {
+        const rejection = rejections.get(event.promise);
+        if (rejection !== undefined) {
+            rejections.delete(event.promise);
+            send('revoked', rejection);
+        }
+    });
+    send('installed');
+})`
+
+// pageChannel pairs the rejections seen by runtimeShim with the Runtime.exceptionThrown sent for them
+type pageChannel struct {
+	lock sync.Mutex
+	// marker of the messages of this session, secret to the page
+	marker string
+	// tells the shim of this session from those of previous ones
+	session string
+	// exceptionIds of the unhandled rejections logged by WebKit and not announced by the page yet
+	pendingRejections []int
+	// exceptionIds by rejection number of the page
+	rejections map[int64]int
+}
+
+func newPageChannel() *pageChannel {
+	return &pageChannel{
+		marker:     pageChannelMarker + randomToken(),
+		session:    randomToken(),
+		rejections: make(map[int64]int),
+	}
+}
+
+func randomToken() string {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		log.Println(e.Convert(err).ToStr())
+	}
+	return hex.EncodeToString(token)
+}
+
+// shim returns runtimeShim called with the marker and the session
+func (c *pageChannel) shim() string {
+	quotedMarker, _ := json.Marshal(c.marker)
+	quotedSession, _ := json.Marshal(c.session)
+	return runtimeShim + "(" + string(quotedMarker) + ", " + string(quotedSession) + ");\n"
+}
+
+func (c *pageChannel) rejectionLogged(exceptionId int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pendingRejections = append(c.pendingRejections, exceptionId)
+}
+
+func (c *pageChannel) rejectionAnnounced(rejection int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.pendingRejections) == 0 {
+		return
+	}
+	c.rejections[rejection] = c.pendingRejections[0]
+	c.pendingRejections = c.pendingRejections[1:]
+}
+
+func (c *pageChannel) revoke(rejection int64) (int, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	exceptionId, ok := c.rejections[rejection]
+	delete(c.rejections, rejection)
+	return exceptionId, ok
+}
+
+// reset forgets the previous document, its rejections cannot be revoked anymore
+func (c *pageChannel) reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pendingRejections = nil
+	c.rejections = make(map[int64]int)
+}
+
+// isMessage tells whether message carries the marker of a page channel, of this session or of a previous one
+func (c *pageChannel) isMessage(message gjson.Result) bool {
+	return message.Get("source").String() == "console-api" &&
+		strings.HasPrefix(message.Get("parameters.0.value").String(), pageChannelMarker)
+}
+
+// onPageChannelMessage acts on the messages of the shim of this session, the others are dropped
+func (p *protocolAdapter) onPageChannelMessage(message gjson.Result) {
+	parameters := message.Get("parameters").Array()
+	if len(parameters) < 2 || parameters[0].Get("value").String() != p.pageChannel.marker {
+		return
+	}
+	switch parameters[1].Get("value").String() {
+	case "installed":
+		p.pageChannel.reset()
+	case "rejection":
+		if len(parameters) > 2 {
+			p.pageChannel.rejectionAnnounced(parameters[2].Get("value").Int())
+		}
+	case "binding":
+		if len(parameters) > 4 {
+			p.onBindingCalled(parameters[2].Get("value").String(), parameters[3].Get("value").String(), parameters[4])
+		}
+	case "revoked":
+		if len(parameters) < 3 {
+			return
+		}
+		if exceptionId, ok := p.pageChannel.revoke(parameters[2].Get("value").Int()); ok {
+			p.adapter.FireEventToTools("Runtime.exceptionRevoked", map[string]interface{}{
+				"reason":      "Handler added to rejected promise",
+				"exceptionId": exceptionId,
+			})
+		}
+	}
+}
+
+// installRuntimeShim runs runtimeShim and installs the bindings in the current document,
+// they are part of the bootstrap script for the next ones
+func (p *protocolAdapter) installRuntimeShim() {
+	p.adapter.CallTarget("Runtime.evaluate", map[string]interface{}{
+		"expression":                           p.pageChannel.shim() + bindingScript(p.bindings.persistent()),
+		"doNotPauseOnExceptionsAndMuteConsole": true,
+	}, p.defaultCallFunc)
+}
+
+// onRuntimeEnable also enables the Console domain, the console events of Runtime and the page channel come from it.
+// Runtime is enabled once the frame origins are known, the existing contexts are announced right away.
+func (p *protocolAdapter) onRuntimeEnable(message []byte) []byte {
+	id := int(gjson.GetBytes(message, "id").Int())
+	p.enableConsole(true)
+	p.installRuntimeShim()
+	p.readFrameOrigins(func() {
+		p.adapter.CallTarget("Runtime.enable", map[string]interface{}{}, func(result []byte) {
+			if isWebkitError(result) {
+				p.adapter.FireErrorToTools(id, serverErrorCode, gjson.GetBytes(result, "message").String())
+				return
+			}
+			p.adapter.FireResultToTools(id, map[string]interface{}{})
+		})
+	})
+	return nil
+}
+
+func (p *protocolAdapter) onRuntimeDisable(message []byte) []byte {
+	p.disableConsole(true)
+	return message
+}
@@ -0,0 +1,485 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"errors"
+	"github.com/tidwall/gjson"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// object ids of the [[Entries]] lists and of their entries, they only exist in the adapter
+const (
+	entriesObjectPrefix = "sonicEntries:"
+	entryObjectPrefix   = "sonicEntry:"
+)
+
+// number of [[Entries]] lists kept for the tool to expand, the oldest ones are dropped
+const maxCollectionEntries = 100
+
+// number of objects whose subtype is remembered, the memory starts over past it
+const maxObservedObjects = 10000
+
+// subtypes of the objects Runtime.getCollectionEntries has entries for
+var collectionSubtypes = map[string]bool{
+	"map":      true,
+	"set":      true,
+	"weakmap":  true,
+	"weakset":  true,
+	"iterator": true,
+}
+
+// CDP names of the internal properties of a promise, WebKit calls them status and result
+var promiseInternalProperties = map[string]string{
+	"status": "[[PromiseState]]",
+	"result": "[[PromiseResult]]",
+}
+
+// buildEntries makes the [[Entries]] array out of its arguments, keys and values in turn when hasKeys is set.
+// With single the only entry is returned instead.
+const buildEntries = `function(hasKeys, single) {
+    const entries = [];
+    const step = hasKeys ? 2 : 1;
+    for (let i = 2; i + step <= arguments.length; i += step) {
+        entries.push(hasKeys ? {key: arguments[i], value: arguments[i + 1]} : {value: arguments[i]});
+    }
+    return single ? entries[0] : entries;
+}`
+
+type collectionEntry struct {
+	key   gjson.Result
+	value gjson.Result
+}
+
+// collectionEntries keeps what Runtime.getCollectionEntries returned, the tool expands [[Entries]] afterwards
+type collectionEntries struct {
+	lock  sync.Mutex
+	next  int
+	lists map[string][]collectionEntry
+	order []string
+	// whether the objects the tool received are collections, by objectId
+	observed map[string]bool
+}
+
+func newCollectionEntries() *collectionEntries {
+	return &collectionEntries{
+		lists:    make(map[string][]collectionEntry),
+		observed: make(map[string]bool),
+	}
+}
+
+// observe remembers whether a remote object sent to the tool is a collection
+func (c *collectionEntries) observe(object gjson.Result) {
+	objectId := object.Get("objectId").String()
+	if objectId == "" {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.observed) >= maxObservedObjects {
+		c.observed = make(map[string]bool)
+	}
+	c.observed[objectId] = collectionSubtypes[object.Get("subtype").String()]
+}
+
+// mayHaveEntries is false for the objects known not to be collections
+func (c *collectionEntries) mayHaveEntries(objectId string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	collection, known := c.observed[objectId]
+	return collection || !known
+}
+
+func (c *collectionEntries) add(entries []collectionEntry) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.next++
+	listId := strconv.Itoa(c.next)
+	c.lists[listId] = entries
+	c.order = append(c.order, listId)
+	if len(c.order) > maxCollectionEntries {
+		delete(c.lists, c.order[0])
+		c.order = c.order[1:]
+	}
+	return listId
+}
+
+func (c *collectionEntries) get(listId string) ([]collectionEntry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entries, ok := c.lists[listId]
+	return entries, ok
+}
+
+// entry returns an entry by its id, the list id and the index in the list
+func (c *collectionEntries) entry(entryId string) (collectionEntry, bool) {
+	parts := strings.SplitN(entryId, ":", 2)
+	index, err := strconv.Atoi(parts[len(parts)-1])
+	entries, ok := c.get(parts[0])
+	if err != nil || !ok || index < 0 || index >= len(entries) {
+		return collectionEntry{}, false
+	}
+	return entries[index], true
+}
+
+func (c *collectionEntries) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lists = make(map[string][]collectionEntry)
+	c.order = nil
+	c.observed = make(map[string]bool)
+}
+
+// isArrayIndex tells whether a property name is an array index, nonIndexedPropertiesOnly leaves them out
+func isArrayIndex(name string) bool {
+	index, err := strconv.ParseUint(name, 10, 32)
+	return err == nil && index < 1<<32-1 && strconv.FormatUint(index, 10) == name
+}
+
+func mapPropertyDescriptor(descriptor gjson.Result) map[string]interface{} {
+	property := map[string]interface{}{
+		"name":         descriptor.Get("name").String(),
+		"configurable": descriptor.Get("configurable").Bool(),
+		"enumerable":   descriptor.Get("enumerable").Bool(),
+		// native getters are evaluated by WebKit and shown as values of the object
+		"isOwn": descriptor.Get("isOwn").Bool() || descriptor.Get("nativeGetter").Bool(),
+	}
+	if value := descriptor.Get("value"); value.Exists() {
+		property["value"] = mapRemoteObject(value)
+		property["writable"] = descriptor.Get("writable").Bool()
+	}
+	if get := descriptor.Get("get"); get.Exists() {
+		property["get"] = mapRemoteObject(get)
+	}
+	if set := descriptor.Get("set"); set.Exists() {
+		property["set"] = mapRemoteObject(set)
+	}
+	if descriptor.Get("wasThrown").Bool() {
+		property["wasThrown"] = true
+	}
+	if symbol := descriptor.Get("symbol"); symbol.Exists() {
+		property["symbol"] = mapRemoteObject(symbol)
+	}
+	return property
+}
+
+// mapInternalProperty names a WebKit internal property the way V8 does, [[Target]] for target
+func mapInternalProperty(descriptor gjson.Result, promise bool) map[string]interface{} {
+	name := descriptor.Get("name").String()
+	value := mapRemoteObject(descriptor.Get("value"))
+	if cdpName, ok := promiseInternalProperties[name]; ok && promise {
+		name = cdpName
+		if value["value"] == "resolved" {
+			value["value"] = "fulfilled"
+			value["description"] = "fulfilled"
+		}
+	} else if name != "" && !strings.HasPrefix(name, "[[") {
+		name = "[[" + strings.ToUpper(name[:1]) + name[1:] + "]]"
+	}
+	return map[string]interface{}{
+		"name":  name,
+		"value": value,
+	}
+}
+
+func entryDescription(entry collectionEntry) string {
+	if entry.key.Exists() {
+		return entry.key.Get("description").String() + " => " + entry.value.Get("description").String()
+	}
+	return entry.value.Get("description").String()
+}
+
+func plainProperty(name string, value map[string]interface{}, enumerable bool) map[string]interface{} {
+	return map[string]interface{}{
+		"name":         name,
+		"value":        value,
+		"writable":     false,
+		"configurable": false,
+		"enumerable":   enumerable,
+		"isOwn":        true,
+	}
+}
+
+// replyCollectionEntries answers getProperties on an [[Entries]] list with its entries and its length
+func (p *protocolAdapter) replyCollectionEntries(id int, listId string) {
+	entries, ok := p.collectionEntries.get(listId)
+	if !ok {
+		p.adapter.FireErrorToTools(id, serverErrorCode, "Could not find object with given id")
+		return
+	}
+	properties := []map[string]interface{}{}
+	for index, entry := range entries {
+		properties = append(properties, plainProperty(strconv.Itoa(index), map[string]interface{}{
+			"type":        "object",
+			"subtype":     "internal#entry",
+			"className":   "Object",
+			"description": entryDescription(entry),
+			"objectId":    entryObjectPrefix + listId + ":" + strconv.Itoa(index),
+		}, true))
+	}
+	properties = append(properties, plainProperty("length", map[string]interface{}{
+		"type":        "number",
+		"value":       len(entries),
+		"description": strconv.Itoa(len(entries)),
+	}, false))
+	p.adapter.FireResultToTools(id, map[string]interface{}{"result": properties})
+}
+
+// replyCollectionEntry answers getProperties on one entry of an [[Entries]] list with its key and value
+func (p *protocolAdapter) replyCollectionEntry(id int, entryId string) {
+	entry, ok := p.collectionEntries.entry(entryId)
+	if !ok {
+		p.adapter.FireErrorToTools(id, serverErrorCode, "Could not find object with given id")
+		return
+	}
+	properties := []map[string]interface{}{}
+	if entry.key.Exists() {
+		properties = append(properties, plainProperty("key", mapRemoteObject(entry.key), true))
+	}
+	properties = append(properties, plainProperty("value", mapRemoteObject(entry.value), true))
+	p.adapter.FireResultToTools(id, map[string]interface{}{"result": properties})
+}
+
+// replyProperties maps the WebKit properties of an object, entries are those of the object when it is a collection
+func (p *protocolAdapter) replyProperties(id int, params gjson.Result, result []byte, entries []collectionEntry) {
+	accessorPropertiesOnly := params.Get("accessorPropertiesOnly").Bool()
+	nonIndexedPropertiesOnly := params.Get("nonIndexedPropertiesOnly").Bool()
+	descriptors := gjson.GetBytes(result, "properties")
+	if !descriptors.Exists() {
+		// iOS 8 answers with result
+		descriptors = gjson.GetBytes(result, "result")
+	}
+
+	properties := []map[string]interface{}{}
+	privateProperties := []map[string]interface{}{}
+	promise := false
+	for _, descriptor := range descriptors.Array() {
+		name := descriptor.Get("name").String()
+		if nonIndexedPropertiesOnly && isArrayIndex(name) {
+			continue
+		}
+		accessor := descriptor.Get("get").Exists() || descriptor.Get("set").Exists() || descriptor.Get("nativeGetter").Bool()
+		if accessorPropertiesOnly && !accessor {
+			continue
+		}
+		p.collectionEntries.observe(descriptor.Get("value"))
+		property := mapPropertyDescriptor(descriptor)
+		if descriptor.Get("isPrivate").Bool() {
+			private := map[string]interface{}{"name": name}
+			for _, key := range []string{"value", "get", "set"} {
+				if value, ok := property[key]; ok {
+					private[key] = value
+				}
+			}
+			privateProperties = append(privateProperties, private)
+			continue
+		}
+		properties = append(properties, property)
+	}
+
+	response := map[string]interface{}{"result": properties}
+	if accessorPropertiesOnly {
+		p.adapter.FireResultToTools(id, response)
+		return
+	}
+	internalProperties := []map[string]interface{}{}
+	webkitInternalProperties := gjson.GetBytes(result, "internalProperties").Array()
+	for _, descriptor := range webkitInternalProperties {
+		// generators have a status too, suspended, running or closed
+		if descriptor.Get("name").String() == "status" {
+			switch descriptor.Get("value.value").String() {
+			case "pending", "resolved", "rejected":
+				promise = true
+			}
+		}
+	}
+	for _, descriptor := range webkitInternalProperties {
+		internalProperties = append(internalProperties, mapInternalProperty(descriptor, promise))
+	}
+	if entries != nil {
+		listId := p.collectionEntries.add(entries)
+		internalProperties = append(internalProperties, map[string]interface{}{
+			"name": "[[Entries]]",
+			"value": map[string]interface{}{
+				"type":        "object",
+				"subtype":     "array",
+				"className":   "Array",
+				"description": "Array(" + strconv.Itoa(len(entries)) + ")",
+				"objectId":    entriesObjectPrefix + listId,
+			},
+		})
+	}
+	if len(internalProperties) > 0 {
+		response["internalProperties"] = internalProperties
+	}
+	if len(privateProperties) > 0 {
+		response["privateProperties"] = privateProperties
+	}
+	p.adapter.FireResultToTools(id, response)
+}
+
+// fetchCollectionEntries gets the entries of a map, a set or of their weak kinds, callback gets nil for other objects
+func (p *protocolAdapter) fetchCollectionEntries(objectId string, callback func(entries []collectionEntry)) {
+	p.adapter.CallTarget("Runtime.getCollectionEntries", map[string]interface{}{
+		"objectId": objectId,
+	}, func(result []byte) {
+		if isWebkitError(result) {
+			callback(nil)
+			return
+		}
+		entries := []collectionEntry{}
+		for _, entry := range gjson.GetBytes(result, "entries").Array() {
+			entries = append(entries, collectionEntry{key: entry.Get("key"), value: entry.Get("value")})
+		}
+		callback(entries)
+	})
+}
+
+func (p *protocolAdapter) onRuntimeGetProperties(message []byte) []byte {
+	msg := string(message)
+	id := int(gjson.Get(msg, "id").Int())
+	params := gjson.Get(msg, "params")
+	objectId := params.Get("objectId").String()
+	if strings.HasPrefix(objectId, entriesObjectPrefix) {
+		p.replyCollectionEntries(id, strings.TrimPrefix(objectId, entriesObjectPrefix))
+		return nil
+	}
+	if strings.HasPrefix(objectId, entryObjectPrefix) {
+		p.replyCollectionEntry(id, strings.TrimPrefix(objectId, entryObjectPrefix))
+		return nil
+	}
+	ownProperties := params.Get("ownProperties").Bool()
+	accessorPropertiesOnly := params.Get("accessorPropertiesOnly").Bool()
+	generatePreview := params.Get("generatePreview").Bool()
+	getProperties := func(entries []collectionEntry) {
+		p.adapter.CallTarget("Runtime.getProperties", map[string]interface{}{
+			"objectId":        objectId,
+			"ownProperties":   ownProperties,
+			"generatePreview": generatePreview,
+		}, func(result []byte) {
+			if isWebkitError(result) {
+				p.adapter.FireErrorToTools(id, serverErrorCode, gjson.GetBytes(result, "message").String())
+				return
+			}
+			p.replyProperties(id, params, result, entries)
+		})
+	}
+	if !ownProperties || accessorPropertiesOnly {
+		getProperties(nil)
+		return nil
+	}
+	// the own properties are what DevTools shows when expanding an object, the displayable ones add
+	// the values of native getters and the entries of collections. Only collections are asked for their entries,
+	// an object the tool got through a message the adapter does not map has an unknown subtype and is asked too.
+	fetchEntries := p.fetchCollectionEntries
+	if !p.collectionEntries.mayHaveEntries(objectId) {
+		fetchEntries = func(objectId string, callback func(entries []collectionEntry)) {
+			callback(nil)
+		}
+	}
+	fetchEntries(objectId, func(entries []collectionEntry) {
+		p.adapter.CallTarget("Runtime.getDisplayableProperties", map[string]interface{}{
+			"objectId":        objectId,
+			"generatePreview": generatePreview,
+		}, func(result []byte) {
+			if isWebkitError(result) {
+				// older WebKit without getDisplayableProperties
+				getProperties(entries)
+				return
+			}
+			p.replyProperties(id, params, result, entries)
+		})
+	})
+	return nil
+}
+
+// entryArgument passes a remote object of an entry back to the page, undefined has neither id nor value
+func entryArgument(object gjson.Result) map[string]interface{} {
+	if objectId := object.Get("objectId"); objectId.Exists() {
+		return map[string]interface{}{"objectId": objectId.String()}
+	}
+	if value := object.Get("value"); value.Exists() {
+		return map[string]interface{}{"value": value.Value()}
+	}
+	return map[string]interface{}{}
+}
+
+// isEntriesObjectId tells whether objectId is an [[Entries]] list or one of its entries, they only exist in the adapter
+func isEntriesObjectId(objectId string) bool {
+	return strings.HasPrefix(objectId, entriesObjectPrefix) || strings.HasPrefix(objectId, entryObjectPrefix)
+}
+
+// materializeEntries builds an [[Entries]] list or one of its entries in the page, for the commands that need
+// a WebKit object. The page global object is the receiver of the construction.
+func (p *protocolAdapter) materializeEntries(objectId string, callback func(objectId string, err error)) {
+	var entries []collectionEntry
+	ok := false
+	single := strings.HasPrefix(objectId, entryObjectPrefix)
+	if single {
+		var entry collectionEntry
+		if entry, ok = p.collectionEntries.entry(strings.TrimPrefix(objectId, entryObjectPrefix)); ok {
+			entries = []collectionEntry{entry}
+		}
+	} else {
+		entries, ok = p.collectionEntries.get(strings.TrimPrefix(objectId, entriesObjectPrefix))
+	}
+	if !ok {
+		callback("", errors.New("Could not find object with given id"))
+		return
+	}
+	hasKeys := len(entries) > 0 && entries[0].key.Exists()
+	arguments := []map[string]interface{}{{"value": hasKeys}, {"value": single}}
+	for _, entry := range entries {
+		if hasKeys {
+			arguments = append(arguments, entryArgument(entry.key))
+		}
+		arguments = append(arguments, entryArgument(entry.value))
+	}
+	p.adapter.CallTarget("Runtime.evaluate", map[string]interface{}{
+		"expression":                           "this",
+		"doNotPauseOnExceptionsAndMuteConsole": true,
+	}, func(global []byte) {
+		globalId := gjson.GetBytes(global, "result.objectId")
+		if isWebkitError(global) || !globalId.Exists() {
+			callback("", errors.New("Could not find object with given id"))
+			return
+		}
+		p.adapter.CallTarget("Runtime.callFunctionOn", map[string]interface{}{
+			"objectId":                             globalId.String(),
+			"functionDeclaration":                  buildEntries,
+			"arguments":                            arguments,
+			"doNotPauseOnExceptionsAndMuteConsole": true,
+		}, func(result []byte) {
+			builtId := gjson.GetBytes(result, "result.objectId")
+			if isWebkitError(result) || gjson.GetBytes(result, "wasThrown").Bool() || !builtId.Exists() {
+				callback("", errors.New("Could not find object with given id"))
+				return
+			}
+			callback(builtId.String(), nil)
+		})
+	})
+}
+
+// onReleaseObject answers for the [[Entries]] objects, they are dropped with the oldest lists
+func (p *protocolAdapter) onReleaseObject(message []byte) []byte {
+	if isEntriesObjectId(gjson.GetBytes(message, "params.objectId").String()) {
+		return p.adapter.ReplyWithEmpty(string(message))
+	}
+	return message
+}
@@ -0,0 +1,143 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"github.com/tidwall/gjson"
+)
+
+// reachableInstances is the fallback of queryInstances, it walks the objects reachable from the global object
+// through data properties only, so that no getter runs, and keeps those inheriting from the prototype it is called on
+const reachableInstances = `function() {
+    const prototype = this;
+    const maxVisited = 100000;
+    const seen = new Set();
+    const found = [];
+    const queue = [window];
+    // a cursor instead of shift, which moves the whole queue every time
+    let next = 0;
+    while (next < queue.length && seen.size < maxVisited) {
+        const object = queue[next++];
+        if (seen.has(object)) {
+            continue;
+        }
+        seen.add(object);
+        if (object !== prototype && Object.prototype.isPrototypeOf.call(prototype, object)) {
+            found.push(object);
+        }
+        let keys = [];
+        try {
+            keys = Reflect.ownKeys(object);
+        } catch (e) {
+        }
+        for (const key of keys) {
+            let descriptor;
+            try {
+                descriptor = Object.getOwnPropertyDescriptor(object, key);
+            } catch (e) {
+                continue;
+            }
+            if (descriptor && 'value' in descriptor) {
+                const value = descriptor.value;
+                if (value !== null && (typeof value === 'object' || typeof value === 'function') && !seen.has(value)) {
+                    queue.push(value);
+                }
+            }
+        }
+        const parent = Object.getPrototypeOf(object);
+        if (parent !== null && !seen.has(parent)) {
+            queue.push(parent);
+        }
+    }
+    return found;
+}`
+
+// queryReachableInstances answers Runtime.queryObjects with the objects reachable from the page
+func (p *protocolAdapter) queryReachableInstances(id int, prototypeObjectId string, objectGroup string) {
+	params := map[string]interface{}{
+		"objectId":                             prototypeObjectId,
+		"functionDeclaration":                  reachableInstances,
+		"doNotPauseOnExceptionsAndMuteConsole": true,
+	}
+	if objectGroup != "" {
+		params["objectGroup"] = objectGroup
+	}
+	p.adapter.CallTarget("Runtime.callFunctionOn", params, func(result []byte) {
+		p.replyQueryObjects(id, result)
+	})
+}
+
+func (p *protocolAdapter) replyQueryObjects(id int, result []byte) {
+	if isWebkitError(result) {
+		p.adapter.FireErrorToTools(id, serverErrorCode, gjson.GetBytes(result, "message").String())
+		return
+	}
+	if gjson.GetBytes(result, "wasThrown").Bool() {
+		p.adapter.FireErrorToTools(id, serverErrorCode, gjson.GetBytes(result, "result.description").String())
+		return
+	}
+	p.adapter.FireResultToTools(id, map[string]interface{}{
+		"objects": mapRemoteObject(gjson.GetBytes(result, "result")),
+	})
+}
+
+// callQueryInstances hands queryInstances of the command line API to the prototype, the function works outside of
+// the console scope it comes from
+const callQueryInstances = `function(queryInstances) {
+    return queryInstances(this);
+}`
+
+// onQueryObjects uses queryInstances of the WebKit command line API, it searches the heap. The function is read
+// from the console scope and called on the prototype, a saved result would show up as $1 and so on in the console.
+// Older WebKit only gets the reachable objects.
+func (p *protocolAdapter) onQueryObjects(message []byte) []byte {
+	msg := string(message)
+	id := int(gjson.Get(msg, "id").Int())
+	prototypeObjectId := gjson.Get(msg, "params.prototypeObjectId").String()
+	objectGroup := gjson.Get(msg, "params.objectGroup").String()
+	p.adapter.CallTarget("Runtime.evaluate", map[string]interface{}{
+		"expression":                           "typeof queryInstances === 'function' ? queryInstances : undefined",
+		"includeCommandLineAPI":                true,
+		"doNotPauseOnExceptionsAndMuteConsole": true,
+	}, func(query []byte) {
+		queryObjectId := gjson.GetBytes(query, "result.objectId").String()
+		if isWebkitError(query) || gjson.GetBytes(query, "result.type").String() != "function" || queryObjectId == "" {
+			p.queryReachableInstances(id, prototypeObjectId, objectGroup)
+			return
+		}
+		params := map[string]interface{}{
+			"objectId":                             prototypeObjectId,
+			"functionDeclaration":                  callQueryInstances,
+			"arguments":                            []map[string]interface{}{{"objectId": queryObjectId}},
+			"doNotPauseOnExceptionsAndMuteConsole": true,
+		}
+		if objectGroup != "" {
+			params["objectGroup"] = objectGroup
+		}
+		p.adapter.CallTarget("Runtime.callFunctionOn", params, func(result []byte) {
+			p.adapter.CallTarget("Runtime.releaseObject", map[string]interface{}{
+				"objectId": queryObjectId,
+			}, p.defaultCallFunc)
+			if isWebkitError(result) || gjson.GetBytes(result, "result.type").String() != "object" {
+				p.queryReachableInstances(id, prototypeObjectId, objectGroup)
+				return
+			}
+			p.replyQueryObjects(id, result)
+		})
+	})
+	return nil
+}
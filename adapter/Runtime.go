@@ -0,0 +1,458 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"errors"
+	"github.com/tidwall/gjson"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// delay between two checks of a promise awaited without Runtime.awaitPromise
+const awaitPromisePollInterval = 50 * time.Millisecond
+
+// awaitPromiseTracker records the outcome of the promise it is called on, strict mode keeps primitives unboxed
+const awaitPromiseTracker = `function() {
+    'use strict';
+    const state = { settled: false, rejected: false, value: undefined };
+    Promise.resolve(this).then(function(value) {
+        state.settled = true;
+        state.value = value;
+    }, function(reason) {
+        state.settled = true;
+        state.rejected = true;
+        state.value = reason;
+    });
+    return state;
+}`
+
+const awaitPromiseSettled = `function() { return this.settled; }`
+
+// awaitPromiseOutcome returns the value of the settled promise, a rejection is thrown again to be reported as such
+const awaitPromiseOutcome = `function() {
+    if (this.rejected) {
+        throw this.value;
+    }
+    return this.value;
+}`
+
+// exceptionInfo reads what WebKit records on a thrown error
+const exceptionInfo = `function() {
+    return {
+        line: typeof this.line === 'number' ? this.line : 0,
+        column: typeof this.column === 'number' ? this.column : 0,
+        sourceURL: typeof this.sourceURL === 'string' ? this.sourceURL : '',
+        stack: typeof this.stack === 'string' ? this.stack : ''
+    };
+}`
+
+// values CallArgument.unserializableValue may hold, a bigint is digits followed by n
+var unserializableValuePattern = regexp.MustCompile(`^(NaN|-?Infinity|-0|-?\d+n)$`)
+
+// one frame of Error.stack in WebKit, "functionName@url:line:column"
+var webkitStackFramePattern = regexp.MustCompile(`^(?:(.*)@)?(.*):(\d+):(\d+)$`)
+
+// runtimeSupport is what the Runtime domain of the target can do, set by initProtocolAdapter
+type runtimeSupport struct {
+	lock sync.Mutex
+	// Runtime.awaitPromise exists
+	nativeAwaitPromise bool
+	// Runtime.evaluate and Runtime.callFunctionOn take awaitPromise
+	nativeAwaitParameter bool
+	nextExceptionId      int
+}
+
+func (r *runtimeSupport) exceptionId() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.nextExceptionId++
+	return r.nextExceptionId
+}
+
+// mapRemoteObject turns a WebKit RemoteObject into its CDP shape
+func mapRemoteObject(object gjson.Result) map[string]interface{} {
+	remoteObject, ok := object.Value().(map[string]interface{})
+	if !ok {
+		return map[string]interface{}{"type": "undefined"}
+	}
+	dropClassSubtype(remoteObject)
+	if preview, ok := remoteObject["preview"].(map[string]interface{}); ok {
+		preview["type"] = remoteObject["type"]
+		preview["description"] = remoteObject["description"]
+		dropClassSubtype(preview)
+		if properties, ok := preview["properties"].([]interface{}); ok {
+			for _, property := range properties {
+				if property, ok := property.(map[string]interface{}); ok {
+					dropClassSubtype(property)
+				}
+			}
+		}
+	}
+	return remoteObject
+}
+
+// dropClassSubtype removes the class subtype WebKit gives to class functions, CDP only knows them as functions
+func dropClassSubtype(object map[string]interface{}) {
+	if object["subtype"] == "class" {
+		delete(object, "subtype")
+	}
+}
+
+// unserializableLiteral is the JavaScript source of a CallArgument.unserializableValue
+func unserializableLiteral(value string) (string, error) {
+	if !unserializableValuePattern.MatchString(value) {
+		return "", errors.New("Invalid unserializable value")
+	}
+	if strings.HasSuffix(value, "n") {
+		return "BigInt(\"" + strings.TrimSuffix(value, "n") + "\")", nil
+	}
+	return value, nil
+}
+
+// callArguments maps CDP CallArguments to WebKit ones. WebKit cannot receive NaN, infinities, -0 or bigints,
+// the declaration is then wrapped to put them in place of a null placeholder.
+func callArguments(declaration string, arguments []gjson.Result) ([]map[string]interface{}, string, error) {
+	var webkitArguments []map[string]interface{}
+	var assignments strings.Builder
+	for index, argument := range arguments {
+		webkitArgument := map[string]interface{}{}
+		switch {
+		case argument.Get("objectId").Exists():
+			webkitArgument["objectId"] = argument.Get("objectId").String()
+		case argument.Get("unserializableValue").Exists():
+			literal, err := unserializableLiteral(argument.Get("unserializableValue").String())
+			if err != nil {
+				return nil, "", err
+			}
+			webkitArgument["value"] = nil
+			assignments.WriteString("    args[" + strconv.Itoa(index) + "] = " + literal + ";\n")
+		case argument.Get("value").Exists():
+			webkitArgument["value"] = argument.Get("value").Value()
+		}
+		webkitArguments = append(webkitArguments, webkitArgument)
+	}
+	if assignments.Len() > 0 {
+		declaration = "function() {\n    const args = Array.prototype.slice.call(arguments);\n" +
+			assignments.String() +
+			"    return (" + declaration + ").apply(this, args);\n}"
+	}
+	return webkitArguments, declaration, nil
+}
+
+// parseWebkitStack turns Error.stack into CDP call frames, native frames have no location and are left out
+func parseWebkitStack(stack string) []map[string]interface{} {
+	callFrames := []map[string]interface{}{}
+	for _, line := range strings.Split(stack, "\n") {
+		match := webkitStackFramePattern.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		functionName := match[1]
+		if strings.HasSuffix(functionName, " code") {
+			// global code, eval code and module code are the top level of a script
+			functionName = ""
+		}
+		lineNumber, _ := strconv.Atoi(match[3])
+		columnNumber, _ := strconv.Atoi(match[4])
+		callFrames = append(callFrames, map[string]interface{}{
+			"functionName": functionName,
+			"scriptId":     "",
+			"url":          match[2],
+			"lineNumber":   zeroBased(lineNumber),
+			"columnNumber": zeroBased(columnNumber),
+		})
+	}
+	return callFrames
+}
+
+// zeroBased converts a WebKit line or column, which starts at 1, to CDP
+func zeroBased(position int) int {
+	if position > 0 {
+		return position - 1
+	}
+	return 0
+}
+
+// exceptionDetails builds CDP exceptionDetails for a thrown WebKit RemoteObject,
+// the location and the stack are read from the error object itself
+func (p *protocolAdapter) exceptionDetails(exception gjson.Result, text string, callback func(details map[string]interface{})) {
+	details := map[string]interface{}{
+		"exceptionId":  p.runtime.exceptionId(),
+		"text":         text,
+		"lineNumber":   0,
+		"columnNumber": 0,
+		"exception":    mapRemoteObject(exception),
+	}
+	objectId := exception.Get("objectId")
+	if !objectId.Exists() {
+		callback(details)
+		return
+	}
+	p.adapter.CallTarget("Runtime.callFunctionOn", map[string]interface{}{
+		"objectId":                             objectId.String(),
+		"functionDeclaration":                  exceptionInfo,
+		"returnByValue":                        true,
+		"doNotPauseOnExceptionsAndMuteConsole": true,
+	}, func(result []byte) {
+		info := gjson.GetBytes(result, "result.value")
+		if isWebkitError(result) || !info.IsObject() {
+			callback(details)
+			return
+		}
+		details["lineNumber"] = zeroBased(int(info.Get("line").Int()))
+		details["columnNumber"] = zeroBased(int(info.Get("column").Int()))
+		if url := info.Get("sourceURL").String(); url != "" {
+			details["url"] = url
+		}
+		if callFrames := parseWebkitStack(info.Get("stack").String()); len(callFrames) > 0 {
+			details["stackTrace"] = map[string]interface{}{"callFrames": callFrames}
+		}
+		callback(details)
+	})
+}
+
+// replyEvaluation answers the tool request id with the CDP shape of a WebKit evaluation result
+func (p *protocolAdapter) replyEvaluation(id int, result []byte, exceptionText string) {
+	if isWebkitError(result) {
+		p.adapter.FireErrorToTools(id, serverErrorCode, gjson.GetBytes(result, "message").String())
+		return
+	}
+	remoteObject := gjson.GetBytes(result, "result")
+	p.collectionEntries.observe(remoteObject)
+	if !gjson.GetBytes(result, "wasThrown").Bool() {
+		p.adapter.FireResultToTools(id, map[string]interface{}{
+			"result": mapRemoteObject(remoteObject),
+		})
+		return
+	}
+	p.exceptionDetails(remoteObject, exceptionText, func(details map[string]interface{}) {
+		p.adapter.FireResultToTools(id, map[string]interface{}{
+			"result":           mapRemoteObject(remoteObject),
+			"exceptionDetails": details,
+		})
+	})
+}
+
+// awaitRemoteObject is Runtime.awaitPromise for targets without it, the outcome of the promise is tracked
+// in the page and polled. callback receives a WebKit evaluation result, wasThrown holds a rejection.
+func (p *protocolAdapter) awaitRemoteObject(objectId string, returnByValue bool, generatePreview bool, callback func(result []byte)) {
+	p.adapter.CallTarget("Runtime.callFunctionOn", map[string]interface{}{
+		"objectId":                             objectId,
+		"functionDeclaration":                  awaitPromiseTracker,
+		"doNotPauseOnExceptionsAndMuteConsole": true,
+	}, func(result []byte) {
+		stateId := gjson.GetBytes(result, "result.objectId")
+		if isWebkitError(result) || !stateId.Exists() {
+			callback([]byte(`{"code":-32000,"message":"Could not find promise with given id"}`))
+			return
+		}
+		var poll func()
+		poll = func() {
+			p.adapter.CallTarget("Runtime.callFunctionOn", map[string]interface{}{
+				"objectId":            stateId.String(),
+				"functionDeclaration": awaitPromiseSettled,
+				"returnByValue":       true,
+			}, func(settled []byte) {
+				if isWebkitError(settled) {
+					// the context of the promise went away
+					callback([]byte(`{"code":-32000,"message":"Promise was collected"}`))
+					return
+				}
+				if !gjson.GetBytes(settled, "result.value").Bool() {
+					time.AfterFunc(awaitPromisePollInterval, poll)
+					return
+				}
+				p.adapter.CallTarget("Runtime.callFunctionOn", map[string]interface{}{
+					"objectId":                             stateId.String(),
+					"functionDeclaration":                  awaitPromiseOutcome,
+					"returnByValue":                        returnByValue,
+					"generatePreview":                      generatePreview,
+					"doNotPauseOnExceptionsAndMuteConsole": true,
+				}, callback)
+			})
+		}
+		poll()
+	})
+}
+
+// resolveCallTarget finds the object a function is called on, the global object of executionContextId without objectId
+func (p *protocolAdapter) resolveCallTarget(params gjson.Result, callback func(objectId string, err error)) {
+	if objectId := params.Get("objectId"); objectId.Exists() {
+		if isEntriesObjectId(objectId.String()) {
+			p.materializeEntries(objectId.String(), callback)
+			return
+		}
+		callback(objectId.String(), nil)
+		return
+	}
+	contextId, ok := p.contextId(params, "executionContextId")
+	if !ok {
+		callback("", errors.New("Either ObjectId or executionContextId must be specified"))
+		return
+	}
+	p.adapter.CallTarget("Runtime.evaluate", map[string]interface{}{
+		"expression":                           "this",
+		"contextId":                            contextId,
+		"doNotPauseOnExceptionsAndMuteConsole": true,
+	}, func(result []byte) {
+		objectId := gjson.GetBytes(result, "result.objectId")
+		if isWebkitError(result) || !objectId.Exists() {
+			callback("", errors.New("Cannot find context with specified id"))
+			return
+		}
+		callback(objectId.String(), nil)
+	})
+}
+
+func (p *protocolAdapter) onCallFunctionOn(message []byte) []byte {
+	msg := string(message)
+	id := int(gjson.Get(msg, "id").Int())
+	params := gjson.Get(msg, "params")
+	// calling a function is a side effect the analysis of an expression cannot rule out
+	if params.Get("throwOnSideEffect").Bool() {
+		p.replySideEffect(id, "Runtime.callFunctionOn with throwOnSideEffect is refused, the function cannot be checked")
+		return nil
+	}
+	arguments, declaration, err := callArguments(params.Get("functionDeclaration").String(), params.Get("arguments").Array())
+	if err != nil {
+		p.adapter.FireErrorToTools(id, serverErrorCode, err.Error())
+		return nil
+	}
+	returnByValue := params.Get("returnByValue").Bool()
+	generatePreview := params.Get("generatePreview").Bool()
+	awaitPromise := params.Get("awaitPromise").Bool()
+	// without the native parameter the returned object is awaited afterwards, it has to stay a reference until then
+	awaitAfterwards := awaitPromise && !p.runtime.nativeAwaitParameter
+
+	p.resolveCallTarget(params, func(objectId string, err error) {
+		if err != nil {
+			p.adapter.FireErrorToTools(id, serverErrorCode, err.Error())
+			return
+		}
+		webkitParams := map[string]interface{}{
+			"objectId":                             objectId,
+			"functionDeclaration":                  declaration,
+			"returnByValue":                        returnByValue && !awaitAfterwards,
+			"generatePreview":                      generatePreview && !awaitAfterwards,
+			"doNotPauseOnExceptionsAndMuteConsole": params.Get("silent").Bool(),
+			"emulateUserGesture":                   params.Get("userGesture").Bool(),
+		}
+		if len(arguments) > 0 {
+			webkitParams["arguments"] = arguments
+		}
+		if awaitPromise && !awaitAfterwards {
+			webkitParams["awaitPromise"] = true
+		}
+		p.adapter.CallTarget("Runtime.callFunctionOn", webkitParams, func(result []byte) {
+			returned := gjson.GetBytes(result, "result.objectId")
+			if awaitAfterwards && !isWebkitError(result) && !gjson.GetBytes(result, "wasThrown").Bool() && returned.Exists() {
+				p.awaitRemoteObject(returned.String(), returnByValue, generatePreview, func(awaited []byte) {
+					p.replyEvaluation(id, awaited, "Uncaught (in promise)")
+				})
+				return
+			}
+			p.replyEvaluation(id, result, "Uncaught")
+		})
+	})
+	return nil
+}
+
+func (p *protocolAdapter) onAwaitPromise(message []byte) []byte {
+	msg := string(message)
+	id := int(gjson.Get(msg, "id").Int())
+	params := gjson.Get(msg, "params")
+	promiseObjectId := params.Get("promiseObjectId").String()
+	returnByValue := params.Get("returnByValue").Bool()
+	generatePreview := params.Get("generatePreview").Bool()
+	reply := func(result []byte) {
+		p.replyEvaluation(id, result, "Uncaught (in promise)")
+	}
+	if !p.runtime.nativeAwaitPromise {
+		p.awaitRemoteObject(promiseObjectId, returnByValue, generatePreview, reply)
+		return nil
+	}
+	p.adapter.CallTarget("Runtime.awaitPromise", map[string]interface{}{
+		"promiseObjectId": promiseObjectId,
+		"returnByValue":   returnByValue,
+		"generatePreview": generatePreview,
+	}, reply)
+	return nil
+}
+
+func (p *protocolAdapter) onRuntimeEvaluate(message []byte) []byte {
+	msg := string(message)
+	id := int(gjson.Get(msg, "id").Int())
+	params := gjson.Get(msg, "params")
+	// WebKit has no side effect free mode, what cannot be proven harmless is not evaluated at all
+	if params.Get("throwOnSideEffect").Bool() && hasSideEffects(params.Get("expression").String()) {
+		p.replySideEffect(id, "")
+		return nil
+	}
+	returnByValue := params.Get("returnByValue").Bool()
+	generatePreview := params.Get("generatePreview").Bool()
+	awaitPromise := params.Get("awaitPromise").Bool()
+	awaitAfterwards := awaitPromise && !p.runtime.nativeAwaitParameter
+
+	webkitParams := map[string]interface{}{
+		"expression":                           params.Get("expression").String(),
+		"includeCommandLineAPI":                params.Get("includeCommandLineAPI").Bool(),
+		"doNotPauseOnExceptionsAndMuteConsole": params.Get("silent").Bool(),
+		"returnByValue":                        returnByValue && !awaitAfterwards,
+		"generatePreview":                      generatePreview && !awaitAfterwards,
+		"emulateUserGesture":                   params.Get("userGesture").Bool(),
+	}
+	if objectGroup := params.Get("objectGroup"); objectGroup.Exists() {
+		webkitParams["objectGroup"] = objectGroup.String()
+	}
+	if contextId, ok := p.contextId(params, "contextId"); ok {
+		webkitParams["contextId"] = contextId
+	} else if params.Get("uniqueContextId").Exists() {
+		p.adapter.FireErrorToTools(id, serverErrorCode, "Cannot find context with specified id")
+		return nil
+	}
+	if awaitPromise && !awaitAfterwards {
+		webkitParams["awaitPromise"] = true
+	}
+
+	// WebKit cannot terminate a running evaluation, a timeout only stops waiting for it
+	var replyOnce sync.Once
+	reply := func(result []byte, exceptionText string) {
+		replyOnce.Do(func() {
+			p.replyEvaluation(id, result, exceptionText)
+		})
+	}
+	if timeout := params.Get("timeout"); timeout.Exists() && timeout.Float() > 0 {
+		time.AfterFunc(time.Duration(timeout.Float()*float64(time.Millisecond)), func() {
+			reply([]byte(`{"code":-32000,"message":"Execution was terminated"}`), "")
+		})
+	}
+	p.adapter.CallTarget("Runtime.evaluate", webkitParams, func(result []byte) {
+		returned := gjson.GetBytes(result, "result.objectId")
+		if awaitAfterwards && !isWebkitError(result) && !gjson.GetBytes(result, "wasThrown").Bool() && returned.Exists() {
+			p.awaitRemoteObject(returned.String(), returnByValue, generatePreview, func(awaited []byte) {
+				reply(awaited, "Uncaught (in promise)")
+			})
+			return
+		}
+		reply(result, "Uncaught")
+	})
+	return nil
+}
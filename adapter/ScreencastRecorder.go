@@ -0,0 +1,325 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/yezihack/e"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type RecordingFormat string
+
+const (
+	// RecordingFormatMJPEG writes a Motion JPEG AVI file
+	RecordingFormatMJPEG RecordingFormat = "mjpeg"
+	// RecordingFormatPNG writes numbered PNG files and a timeline.json into a directory
+	RecordingFormatPNG RecordingFormat = "png"
+)
+
+// snapshots waiting to be written, older ones are dropped when the disk is slower than the page
+const recorderQueueSize = 16
+
+type recordedFrame struct {
+	File      string                 `json:"file"`
+	Timestamp float64                `json:"timestamp"`
+	Metadata  map[string]interface{} `json:"metadata"`
+}
+
+// ScreencastRecorder writes the screencast snapshots to disk, with or without DevTools attached
+type ScreencastRecorder struct {
+	protocol  *protocolAdapter
+	path      string
+	format    RecordingFormat
+	quality   int
+	frameRate int
+	maxWidth  int
+	maxHeight int
+
+	// lock guards stopped, the screencast may still deliver a frame while Stop closes snapshots
+	lock      sync.Mutex
+	stopped   bool
+	snapshots chan *screencastSnapshot
+	done      chan struct{}
+	stopOnce  sync.Once
+	err       error
+
+	// mjpeg state
+	avi          *aviWriter
+	width        int
+	height       int
+	startedAt    time.Time
+	writtenSlots int
+	lastJPEG     []byte
+	lastWritten  bool
+
+	// png state
+	frameCount int
+	timeline   []recordedFrame
+}
+
+type RecorderOptFunc func(recorder *ScreencastRecorder)
+
+func WithRecordingQuality(quality int) RecorderOptFunc {
+	return func(recorder *ScreencastRecorder) {
+		recorder.quality = quality
+	}
+}
+
+// WithRecordingFrameRate sets the frame rate of MJPEG files, snapshots are repeated to keep real time
+func WithRecordingFrameRate(frameRate int) RecorderOptFunc {
+	return func(recorder *ScreencastRecorder) {
+		recorder.frameRate = frameRate
+	}
+}
+
+func WithRecordingMaxSize(maxWidth int, maxHeight int) RecorderOptFunc {
+	return func(recorder *ScreencastRecorder) {
+		recorder.maxWidth = maxWidth
+		recorder.maxHeight = maxHeight
+	}
+}
+
+// StartScreencastRecording records the page into path, a file for MJPEG and a directory for PNG,
+// until Stop is called on the returned recorder
+func (a *Adapter) StartScreencastRecording(path string, format RecordingFormat, optFuncs ...RecorderOptFunc) (*ScreencastRecorder, error) {
+	recorder, err := newScreencastRecorder(a.protocol, path, format, optFuncs...)
+	if err != nil {
+		return nil, err
+	}
+	go recorder.run()
+	a.protocol.acquireScreencast().addSink(recorder)
+	return recorder, nil
+}
+
+func newScreencastRecorder(protocol *protocolAdapter, path string, format RecordingFormat, optFuncs ...RecorderOptFunc) (*ScreencastRecorder, error) {
+	recorder := &ScreencastRecorder{
+		protocol:  protocol,
+		path:      path,
+		format:    format,
+		quality:   defaultImageQuality,
+		frameRate: 10,
+		snapshots: make(chan *screencastSnapshot, recorderQueueSize),
+		done:      make(chan struct{}),
+		timeline:  []recordedFrame{},
+	}
+	for _, optFunc := range optFuncs {
+		optFunc(recorder)
+	}
+	if recorder.frameRate < 1 {
+		recorder.frameRate = 1
+	}
+	switch format {
+	case RecordingFormatMJPEG:
+		// a bad path fails here rather than at Stop
+		avi, err := newAviWriter(path, recorder.frameRate)
+		if err != nil {
+			return nil, err
+		}
+		recorder.avi = avi
+	case RecordingFormatPNG:
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unsupported recording format " + string(format))
+	}
+	return recorder, nil
+}
+
+// Stop detaches the recorder from the screencast and finalizes the files
+func (r *ScreencastRecorder) Stop() error {
+	r.stopOnce.Do(func() {
+		r.protocol.releaseScreencast(func(screencast *screencastSession) {
+			screencast.removeSink(r)
+		})
+		r.lock.Lock()
+		r.stopped = true
+		close(r.snapshots)
+		r.lock.Unlock()
+		<-r.done
+	})
+	return r.err
+}
+
+func (r *ScreencastRecorder) writeFrame(snapshot *screencastSnapshot) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stopped {
+		return
+	}
+	select {
+	case r.snapshots <- snapshot:
+	default:
+		log.Println("screencast recorder: disk too slow, frame dropped")
+	}
+}
+
+func (r *ScreencastRecorder) run() {
+	defer close(r.done)
+	for snapshot := range r.snapshots {
+		if r.err != nil {
+			continue
+		}
+		var err error
+		if r.format == RecordingFormatMJPEG {
+			err = r.writeMJPEG(snapshot)
+		} else {
+			err = r.writePNG(snapshot)
+		}
+		if err != nil {
+			log.Println(e.Convert(err).ToStr())
+			r.err = err
+		}
+	}
+	if err := r.finish(); err != nil && r.err == nil {
+		r.err = err
+	}
+}
+
+// writeMJPEG places the snapshot on the constant frame rate timeline of the AVI file,
+// repeating the previous frame over the time the page did not change
+func (r *ScreencastRecorder) writeMJPEG(snapshot *screencastSnapshot) error {
+	img, err := snapshot.decode()
+	if err != nil {
+		return err
+	}
+	if r.width == 0 {
+		bounds := img.Bounds()
+		r.width, r.height = fitSize(bounds.Dx(), bounds.Dy(), r.maxWidth, r.maxHeight)
+		if err = r.avi.setFrameSize(r.width, r.height); err != nil {
+			return err
+		}
+		r.startedAt = snapshot.capturedAt
+	}
+	jpegData, err := r.encodeJPEG(img)
+	if err != nil {
+		return err
+	}
+	slot := int(snapshot.capturedAt.Sub(r.startedAt).Seconds() * float64(r.frameRate))
+	if err = r.fillSlots(slot); err != nil {
+		return err
+	}
+	r.lastJPEG = jpegData
+	r.lastWritten = false
+	if r.writtenSlots <= slot {
+		if err = r.avi.writeFrame(jpegData); err != nil {
+			return err
+		}
+		r.writtenSlots++
+		r.lastWritten = true
+	}
+	return nil
+}
+
+// fillSlots repeats the last frame until slot
+func (r *ScreencastRecorder) fillSlots(slot int) error {
+	for r.lastJPEG != nil && r.writtenSlots < slot {
+		if err := r.avi.writeFrame(r.lastJPEG); err != nil {
+			return err
+		}
+		r.writtenSlots++
+		r.lastWritten = true
+	}
+	return nil
+}
+
+func (r *ScreencastRecorder) encodeJPEG(img image.Image) ([]byte, error) {
+	bounds := img.Bounds()
+	// the AVI frame size is fixed by the first snapshot, later ones follow it even after a rotation
+	if bounds.Dx() != r.width || bounds.Dy() != r.height {
+		img = scaleImage(img, r.width, r.height)
+	}
+	return encodeImage(img, "jpeg", r.quality)
+}
+
+func (r *ScreencastRecorder) writePNG(snapshot *screencastSnapshot) error {
+	var data []byte
+	if r.maxWidth > 0 || r.maxHeight > 0 {
+		img, err := snapshot.decode()
+		if err != nil {
+			return err
+		}
+		bounds := img.Bounds()
+		width, height := fitSize(bounds.Dx(), bounds.Dy(), r.maxWidth, r.maxHeight)
+		data, err = encodeImage(scaleImage(img, width, height), "png", 0)
+		if err != nil {
+			return err
+		}
+	} else {
+		// snapshots already are PNG
+		payload, err := splitDataURL(snapshot.dataURL)
+		if err != nil {
+			return err
+		}
+		data, err = base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			return err
+		}
+	}
+	if r.frameCount == 0 {
+		r.startedAt = snapshot.capturedAt
+	}
+	r.frameCount++
+	name := fmt.Sprintf("frame-%06d.png", r.frameCount)
+	if err := os.WriteFile(filepath.Join(r.path, name), data, 0644); err != nil {
+		return err
+	}
+	r.timeline = append(r.timeline, recordedFrame{
+		File:      name,
+		Timestamp: snapshot.capturedAt.Sub(r.startedAt).Seconds(),
+		Metadata:  snapshot.metadata,
+	})
+	return nil
+}
+
+func (r *ScreencastRecorder) finish() error {
+	if r.format == RecordingFormatPNG {
+		data, err := json.MarshalIndent(r.timeline, "", "  ")
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(r.path, "timeline.json"), data, 0644)
+	}
+	if r.lastJPEG == nil {
+		r.avi.close()
+		return errors.New("no frame was recorded")
+	}
+	if r.err == nil {
+		// keep the last frame on screen until the recording stopped
+		slot := int(time.Since(r.startedAt).Seconds() * float64(r.frameRate))
+		if err := r.fillSlots(slot); err != nil {
+			r.avi.close()
+			return err
+		}
+		if !r.lastWritten {
+			if err := r.avi.writeFrame(r.lastJPEG); err != nil {
+				r.avi.close()
+				return err
+			}
+		}
+	}
+	return r.avi.close()
+}
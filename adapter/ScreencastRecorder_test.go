@@ -0,0 +1,77 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func pngSnapshot(t *testing.T) *screencastSnapshot {
+	var data bytes.Buffer
+	if err := png.Encode(&data, gradientImage(16, 12)); err != nil {
+		t.Fatal(err)
+	}
+	return &screencastSnapshot{
+		dataURL:    "data:image/png;base64," + base64.StdEncoding.EncodeToString(data.Bytes()),
+		capturedAt: time.Now(),
+	}
+}
+
+func TestScreencastRecorderStopWhileDelivering(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.avi")
+	// no screencast is running, Stop only has the recorder to finalize
+	recorder, err := newScreencastRecorder(&protocolAdapter{}, path, RecordingFormatMJPEG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go recorder.run()
+	recorder.writeFrame(pngSnapshot(t))
+
+	var delivering sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		delivering.Add(1)
+		go func() {
+			defer delivering.Done()
+			for j := 0; j < 200; j++ {
+				recorder.writeFrame(pngSnapshot(t))
+			}
+		}()
+	}
+	if err = recorder.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	delivering.Wait()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data[0:4]) != "RIFF" || string(data[8:12]) != "AVI " {
+		t.Fatalf("bad RIFF header %q", data[:12])
+	}
+	chunks := readChunks(t, data[12:], 12)
+	if chunks[len(chunks)-1].id != "idx1" || len(chunks[len(chunks)-1].data) == 0 {
+		t.Fatal("the recording has no index")
+	}
+}
@@ -17,172 +17,488 @@
 package adapters
 
 import (
+	"encoding/base64"
 	"github.com/tidwall/gjson"
 	"github.com/yezihack/e"
+	"hash/fnv"
+	"image"
 	"log"
-	"strconv"
-	"strings"
+	"math"
+	"sync"
 	"time"
 )
 
+// frames older than this are considered lost, so a tool that stopped acking cannot stall the screencast
+const screencastAckTimeout = 5 * time.Second
+
+// bound of a single WebKit call made by the screencast loop
+const screencastCallTimeout = 10 * time.Second
+
 type screencastSession struct {
-	adapter         *Adapter
-	frameId         int
-	framesAcked     map[int]bool
-	frameInterval   time.Duration // default 250, 60 fps is 16ms
-	format          string
-	quality         int
-	maxWidth        int
-	maxHeight       int
-	timerCookie     interface{}
-	deviceWidth     int
-	deviceHeight    int
-	offsetTop       int
-	pageScaleFactor int
-	scrollOffsetX   int
-	scrollOffsetY   int
-	closeFlag       chan bool
+	adapter *Adapter
+	frameId int
+	// minimum delay between two frames, 60 fps is 16ms
+	frameInterval time.Duration
+	// slowest pace, reached on static pages or slow links
+	maxFrameInterval  time.Duration
+	maxFramesInFlight int
+	everyNthFrame     int
+	format            string
+	quality           int
+	maxWidth          int
+	maxHeight         int
+
+	lock sync.Mutex
+	// send time of the frames not acked yet, by sessionId
+	framesInFlight map[int]time.Time
+	// moving averages used to pace the loop
+	ackLatency  time.Duration
+	captureCost time.Duration
+	// changed frames seen, for everyNthFrame
+	changedFrames int
+	// consecutive snapshots identical to the last frame sent
+	unchangedFrames int
+	lastFrameHash   uint64
+	// geometry of the last frame sent to DevTools, its Input coordinates refer to it
+	toolViewport screencastViewport
+	// document.visibilityState of the page, snapshots are not taken while it is hidden
+	visible bool
+	// DevTools asked for Page.screencastFrame events
+	toolAttached bool
+	// other consumers of the snapshots, like recorders
+	sinks     []screencastFrameSink
+	ackSignal chan struct{}
+	closeFlag chan struct{}
+	closeOnce sync.Once
+}
+
+// screencastSnapshot is a viewport snapshot shared by every consumer of the session
+type screencastSnapshot struct {
+	dataURL    string
+	metadata   map[string]interface{}
+	capturedAt time.Time
+	viewport   screencastViewport
+	decodeOnce sync.Once
+	image      image.Image
+	decodeErr  error
+}
+
+// decode returns the snapshot image, decoded once whatever the number of consumers
+func (f *screencastSnapshot) decode() (image.Image, error) {
+	f.decodeOnce.Do(func() {
+		f.image, f.decodeErr = decodeDataURL(f.dataURL)
+	})
+	return f.image, f.decodeErr
+}
+
+// screencastEncoding is the DevTools facing frame settings, copied under the lock for the encoder
+type screencastEncoding struct {
+	format    string
+	quality   int
+	maxWidth  int
+	maxHeight int
+}
+
+// screencastFrameSink receives the snapshots of a session besides DevTools,
+// writeFrame is called from the capture loop and must not block
+type screencastFrameSink interface {
+	writeFrame(snapshot *screencastSnapshot)
 }
 
 func newScreencastSession(adapter *Adapter, optFuncs ...ScreencastOptFunc) *screencastSession {
 	screencast := &screencastSession{
-		adapter:   adapter,
-		quality:   100,
-		format:    "jpg",
-		maxHeight: 1024,
-		maxWidth:  1024,
+		adapter:      adapter,
+		visible:      true,
+		toolViewport: identityViewport,
+		// defaults first, WithFrameInterval may override them
+		frameInterval:    50 * time.Millisecond,
+		maxFrameInterval: time.Second,
 	}
-	screencast.frameInterval = 250
+	screencast.applyOptions(optFuncs...)
 
-	screencast.closeFlag = make(chan bool)
+	screencast.framesInFlight = make(map[int]time.Time)
+	screencast.ackSignal = make(chan struct{}, 1)
+	screencast.closeFlag = make(chan struct{})
+	return screencast
+}
 
-	if len(optFuncs) != 0 {
-		for _, optFunc := range optFuncs {
-			optFunc(screencast)
-		}
+// applyOptions resets the DevTools facing settings to their defaults before applying optFuncs
+func (s *screencastSession) applyOptions(optFuncs ...ScreencastOptFunc) {
+	s.quality = 100
+	s.format = "jpg"
+	s.maxHeight = 1024
+	s.maxWidth = 1024
+	s.maxFramesInFlight = 1
+	s.everyNthFrame = 1
+	for _, optFunc := range optFuncs {
+		optFunc(s)
+	}
+	if s.maxFramesInFlight < 1 {
+		s.maxFramesInFlight = 1
+	}
+	if s.everyNthFrame < 1 {
+		s.everyNthFrame = 1
 	}
-	return screencast
 }
 
 func (s *screencastSession) start() {
-	s.framesAcked = make(map[int]bool)
 	s.frameId = 1
-	var err error
-	params := map[string]interface{}{
-		"expression": `(window.innerWidth > 0 ? window.innerWidth : screen.width) + "," + (window.innerHeight > 0 ? window.innerHeight : screen.height) + "," + window.devicePixelRatio`,
-	}
-	s.adapter.CallTarget("Runtime.evaluate", params, func(message []byte) {
-		parts := strings.Split(gjson.Get(string(message), "result.value").String(), ",")
-		var deviceWidth int
-		var deviceHeight int
-		var pageScaleFactor int
-		deviceWidth, err = strconv.Atoi(parts[0])
-		if err != nil {
-			log.Println(e.Convert(err).ToStr())
-		}
-		deviceHeight, err = strconv.Atoi(parts[1])
-		if err != nil {
-			log.Println(e.Convert(err).ToStr())
-		}
-		pageScaleFactor, err = strconv.Atoi(parts[2])
-		if err != nil {
-			log.Println(e.Convert(err).ToStr())
+	go s.recordingLoop()
+}
+
+// attachTool starts sending Page.screencastFrame events with the tool settings
+func (s *screencastSession) attachTool(optFuncs ...ScreencastOptFunc) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.applyOptions(optFuncs...)
+	s.toolAttached = true
+	s.changedFrames = 0
+	s.framesInFlight = make(map[int]time.Time)
+	// the tool has no frame yet, even if the page did not change
+	s.lastFrameHash = 0
+	if !s.visible {
+		s.adapter.FireEventToTools("Page.screencastVisibilityChanged", map[string]interface{}{
+			"visible": false,
+		})
+	}
+}
+
+func (s *screencastSession) detachTool() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.toolAttached = false
+	s.framesInFlight = make(map[int]time.Time)
+}
+
+func (s *screencastSession) addSink(sink screencastFrameSink) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sinks = append(s.sinks, sink)
+	// a new consumer needs the current page even if it did not change
+	s.lastFrameHash = 0
+}
+
+func (s *screencastSession) removeSink(sink screencastFrameSink) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for index, value := range s.sinks {
+		if value == sink {
+			s.sinks = append(s.sinks[:index], s.sinks[index+1:]...)
+			return
 		}
-		s.deviceWidth = deviceWidth
-		s.deviceHeight = deviceHeight
-		s.pageScaleFactor = pageScaleFactor
-
-		ticker := time.NewTicker(s.frameInterval * time.Millisecond)
-		go func() {
-			for {
-				select {
-				case <-ticker.C:
-					s.recordingLoop()
-				case <-s.closeFlag:
-					return
-				}
-			}
-		}()
-	})
+	}
+}
+
+// idle reports that nobody consumes the snapshots anymore
+func (s *screencastSession) idle() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return !s.toolAttached && len(s.sinks) == 0
 }
 
 func (s *screencastSession) stop() {
-	if s.closeFlag == nil {
-		return
-	}
-	s.closeFlag <- true
+	s.closeOnce.Do(func() {
+		close(s.closeFlag)
+	})
 }
 
 func (s *screencastSession) ackFrame(frameNumber int) {
-	s.framesAcked[frameNumber] = true
+	s.lock.Lock()
+	sentAt, ok := s.framesInFlight[frameNumber]
+	if ok {
+		delete(s.framesInFlight, frameNumber)
+		s.ackLatency = movingAverage(s.ackLatency, time.Since(sentAt))
+	}
+	s.lock.Unlock()
+	select {
+	case s.ackSignal <- struct{}{}:
+	default:
+	}
 }
 
 func (s *screencastSession) recordingLoop() {
-	currentFrame := s.frameId
-	frameAckFlag, ok := s.framesAcked[currentFrame-1]
-	if currentFrame > 1 && (ok || !frameAckFlag) {
-		return
-	}
-	s.frameId++
-	params := map[string]interface{}{
-		"expression": `window.document.body.offsetTop + "," + window.pageXOffset + "," + window.pageYOffset`,
-	}
-	s.adapter.CallTarget("Runtime.evaluate", params, func(message []byte) {
-		if !gjson.Get(string(message), "wasThrown").Exists() || gjson.Get(string(message), "wasThrown").Bool() {
+	var lastCaptureDuration time.Duration
+	for {
+		select {
+		case <-s.closeFlag:
+			return
+		case <-time.After(s.nextFrameDelay(lastCaptureDuration)):
+		}
+		if !s.waitForFrameSlot() {
 			return
 		}
-		parts := strings.Split(gjson.Get(string(message), "result.value").String(), ",")
-		var offsetTop int
-		var scrollOffsetX int
-		var scrollOffsetY int
-		var err error
-		offsetTop, err = strconv.Atoi(parts[0])
-		if err != nil {
-			log.Println(e.Convert(err).ToStr())
+		captureStart := time.Now()
+		snapshot, ok := s.captureFrame()
+		if ok {
+			s.deliver(snapshot)
 		}
-		scrollOffsetX, err = strconv.Atoi(parts[1])
-		if err != nil {
-			log.Println(e.Convert(err).ToStr())
+		lastCaptureDuration = time.Since(captureStart)
+		s.lock.Lock()
+		s.captureCost = movingAverage(s.captureCost, lastCaptureDuration)
+		s.lock.Unlock()
+	}
+}
+
+// nextFrameDelay paces the loop on the slowest of snapshot cost and ack latency,
+// and backs off while the page does not change
+func (s *screencastSession) nextFrameDelay(lastCaptureDuration time.Duration) time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	interval := s.frameInterval
+	if !s.visible {
+		// only the visibility is polled while the page is hidden
+		interval = s.maxFrameInterval
+	}
+	if s.captureCost > interval {
+		interval = s.captureCost
+	}
+	if perFrameAck := s.ackLatency / time.Duration(s.maxFramesInFlight); perFrameAck > interval {
+		interval = perFrameAck
+	}
+	for i := 0; i < s.unchangedFrames && interval < s.maxFrameInterval; i++ {
+		interval *= 2
+	}
+	if interval > s.maxFrameInterval {
+		interval = s.maxFrameInterval
+	}
+	delay := interval - lastCaptureDuration
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+// waitForFrameSlot blocks while maxFramesInFlight frames are waiting for an ack of DevTools
+func (s *screencastSession) waitForFrameSlot() bool {
+	for {
+		s.lock.Lock()
+		for frameNumber, sentAt := range s.framesInFlight {
+			if time.Since(sentAt) > screencastAckTimeout {
+				delete(s.framesInFlight, frameNumber)
+			}
 		}
-		scrollOffsetY, err = strconv.Atoi(parts[2])
-		if err != nil {
-			log.Println(e.Convert(err).ToStr())
+		available := !s.toolAttached || len(s.framesInFlight) < s.maxFramesInFlight
+		s.lock.Unlock()
+		if available {
+			return true
 		}
-		s.offsetTop = offsetTop
-		s.scrollOffsetY = scrollOffsetY
-		s.scrollOffsetX = scrollOffsetX
-
-		snapshotRectParams := map[string]interface{}{
-			"x":                0,
-			"y":                0,
-			"width":            s.deviceWidth,
-			"height":           s.deviceHeight,
-			"coordinateSystem": "Viewport",
+		select {
+		case <-s.closeFlag:
+			return false
+		case <-s.ackSignal:
+		case <-time.After(screencastAckTimeout):
 		}
-		s.adapter.CallTarget("Page.snapshotRect", snapshotRectParams, func(msg []byte) {
-			dataURL := gjson.Get(string(msg), "dataURL").String()
-			index := strings.Index(dataURL, "base64")
-
-			frame := map[string]interface{}{
-				"data": dataURL[index+7:],
-				"metadata": map[string]interface{}{
-					"pageScaleFactor": s.pageScaleFactor,
-					"offsetTop":       s.offsetTop,
-					"deviceWidth":     s.deviceWidth,
-					"deviceHeight":    s.deviceHeight,
-					"scrollOffsetX":   s.scrollOffsetX,
-					"scrollOffsetY":   s.scrollOffsetY,
-					"timestamp":       time.Now().UnixNano(),
-				},
-				"sessionId": currentFrame,
-			}
+	}
+}
 
-			s.adapter.FireEventToTools("Page.screencastFrame", frame)
+// callTarget issues a WebKit command from the screencast loop and waits for its result
+func (s *screencastSession) callTarget(method string, params interface{}) ([]byte, bool) {
+	result := make(chan []byte, 1)
+	s.adapter.CallTarget(method, params, func(message []byte) {
+		result <- message
+	})
+	select {
+	case message := <-result:
+		return message, true
+	case <-s.closeFlag:
+		return nil, false
+	case <-time.After(screencastCallTimeout):
+		log.Println("screencast: no reply to " + method)
+		return nil, false
+	}
+}
+
+// captureFrame snapshots the viewport, it returns false when there is nothing new to deliver
+func (s *screencastSession) captureFrame() (*screencastSnapshot, bool) {
+	params := map[string]interface{}{
+		"expression":    viewportExpression,
+		"returnByValue": true,
+	}
+	message, ok := s.callTarget("Runtime.evaluate", params)
+	if !ok {
+		select {
+		case <-s.closeFlag:
+		default:
+			// the web content process does not answer while the app is in background
+			s.setVisible(false)
+		}
+		return nil, false
+	}
+	if gjson.Get(string(message), "wasThrown").Bool() {
+		return nil, false
+	}
+	value := gjson.Get(string(message), "result.value")
+	if !value.Exists() {
+		return nil, false
+	}
+	if !s.setVisible(value.Get("visible").Bool()) {
+		return nil, false
+	}
+	viewport := parseScreencastViewport(value)
+	if viewport.width <= 0 || viewport.height <= 0 {
+		return nil, false
+	}
+
+	snapshotRectParams := map[string]interface{}{
+		"x":                0,
+		"y":                0,
+		"width":            int(math.Ceil(viewport.width)),
+		"height":           int(math.Ceil(viewport.height)),
+		"coordinateSystem": "Viewport",
+	}
+	msg, ok := s.callTarget("Page.snapshotRect", snapshotRectParams)
+	if !ok {
+		return nil, false
+	}
+	dataURL := gjson.Get(string(msg), "dataURL").String()
+	if dataURL == "" {
+		return nil, false
+	}
+
+	// identical snapshots are not worth decoding nor sending
+	hash := fnv.New64a()
+	hash.Write([]byte(dataURL))
+	frameHash := hash.Sum64()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if frameHash == s.lastFrameHash {
+		s.unchangedFrames++
+		return nil, false
+	}
+	s.unchangedFrames = 0
+	s.lastFrameHash = frameHash
+
+	capturedAt := time.Now()
+	return &screencastSnapshot{
+		dataURL:    dataURL,
+		capturedAt: capturedAt,
+		viewport:   viewport,
+		metadata:   viewport.metadata(capturedAt),
+	}, true
+}
+
+// setVisible records the page visibility and tells DevTools when it changes, it returns the visibility
+func (s *screencastSession) setVisible(visible bool) bool {
+	s.lock.Lock()
+	changed := s.visible != visible
+	s.visible = visible
+	if changed && visible {
+		// the page may have changed while it was hidden
+		s.lastFrameHash = 0
+	}
+	notify := changed && s.toolAttached
+	s.lock.Unlock()
+	if notify {
+		s.adapter.FireEventToTools("Page.screencastVisibilityChanged", map[string]interface{}{
+			"visible": visible,
 		})
+	}
+	return visible
+}
+
+// deliver hands a changed snapshot to the sinks, and to DevTools every everyNthFrame frames
+func (s *screencastSession) deliver(snapshot *screencastSnapshot) {
+	s.lock.Lock()
+	sinks := make([]screencastFrameSink, len(s.sinks))
+	copy(sinks, s.sinks)
+	sendToTool := false
+	if s.toolAttached {
+		s.changedFrames++
+		sendToTool = s.changedFrames%s.everyNthFrame == 0
+	}
+	encoding := screencastEncoding{
+		format:    s.format,
+		quality:   s.quality,
+		maxWidth:  s.maxWidth,
+		maxHeight: s.maxHeight,
+	}
+	s.lock.Unlock()
 
+	for _, sink := range sinks {
+		sink.writeFrame(snapshot)
+	}
+	if !sendToTool {
+		return
+	}
+	data, frameScale, err := encodeFrame(snapshot, encoding)
+	if err != nil {
+		log.Println(e.Convert(err).ToStr())
+		return
+	}
+	viewport := snapshot.viewport
+	viewport.frameScale = frameScale
+	s.lock.Lock()
+	s.toolViewport = viewport
+	s.lock.Unlock()
+	s.sendFrame(data, snapshot.metadata)
+}
+
+// viewport returns the geometry of the last frame DevTools received
+func (s *screencastSession) viewport() screencastViewport {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.toolViewport
+}
+
+func (s *screencastSession) sendFrame(data string, metadata map[string]interface{}) {
+	s.lock.Lock()
+	currentFrame := s.frameId
+	s.frameId++
+	s.framesInFlight[currentFrame] = time.Now()
+	s.lock.Unlock()
+
+	s.adapter.FireEventToTools("Page.screencastFrame", map[string]interface{}{
+		"data":      data,
+		"metadata":  metadata,
+		"sessionId": currentFrame,
 	})
 }
 
+// encodeFrame fits the snapshot into maxWidth x maxHeight and encodes it in the format of encoding,
+// it also returns the frame pixels per DIP so frame coordinates can be mapped back to the page
+func encodeFrame(snapshot *screencastSnapshot, encoding screencastEncoding) (string, float64, error) {
+	img, err := snapshot.decode()
+	if err != nil {
+		return "", 0, err
+	}
+	bounds := img.Bounds()
+	width, height := fitSize(bounds.Dx(), bounds.Dy(), encoding.maxWidth, encoding.maxHeight)
+	if width != bounds.Dx() || height != bounds.Dy() {
+		img = scaleImage(img, width, height)
+	}
+	data, err := encodeImage(img, encoding.format, encoding.quality)
+	if err != nil {
+		return "", 0, err
+	}
+	frameScale := 1.0
+	if deviceWidth := snapshot.viewport.deviceWidth(); deviceWidth > 0 {
+		frameScale = float64(width) / deviceWidth
+	}
+	return base64.StdEncoding.EncodeToString(data), frameScale, nil
+}
+
+// fitSize shrinks width x height to fit in maxWidth x maxHeight keeping the aspect ratio, 0 means no limit
+func fitSize(width int, height int, maxWidth int, maxHeight int) (int, int) {
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = math.Min(scale, float64(maxWidth)/float64(width))
+	}
+	if maxHeight > 0 && height > maxHeight {
+		scale = math.Min(scale, float64(maxHeight)/float64(height))
+	}
+	if scale == 1 {
+		return width, height
+	}
+	return int(math.Round(float64(width) * scale)), int(math.Round(float64(height) * scale))
+}
+
+func movingAverage(average time.Duration, sample time.Duration) time.Duration {
+	if average == 0 {
+		return sample
+	}
+	return average + (sample-average)/4
+}
+
 type ScreencastOptFunc func(screencast *screencastSession)
 
 func WithFormat(format string) ScreencastOptFunc {
@@ -208,3 +524,21 @@ func WithMaxWidth(maxWidth int) ScreencastOptFunc {
 		screencast.maxWidth = maxWidth
 	}
 }
+
+func WithEveryNthFrame(everyNthFrame int) ScreencastOptFunc {
+	return func(screencast *screencastSession) {
+		screencast.everyNthFrame = everyNthFrame
+	}
+}
+
+func WithMaxFramesInFlight(maxFramesInFlight int) ScreencastOptFunc {
+	return func(screencast *screencastSession) {
+		screencast.maxFramesInFlight = maxFramesInFlight
+	}
+}
+
+func WithFrameInterval(frameInterval time.Duration) ScreencastOptFunc {
+	return func(screencast *screencastSession) {
+		screencast.frameInterval = frameInterval
+	}
+}
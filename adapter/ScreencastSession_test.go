@@ -0,0 +1,39 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import "testing"
+
+func TestFitSize(t *testing.T) {
+	tests := []struct {
+		width, height, maxWidth, maxHeight int
+		wantWidth, wantHeight              int
+	}{
+		{800, 600, 0, 0, 800, 600},
+		{800, 600, 1024, 1024, 800, 600},
+		{2000, 1000, 1000, 0, 1000, 500},
+		{1000, 2000, 1000, 1000, 500, 1000},
+		{1170, 2532, 375, 812, 375, 812},
+	}
+	for _, test := range tests {
+		width, height := fitSize(test.width, test.height, test.maxWidth, test.maxHeight)
+		if width != test.wantWidth || height != test.wantHeight {
+			t.Errorf("fitSize(%d, %d, %d, %d) = %dx%d, want %dx%d", test.width, test.height, test.maxWidth,
+				test.maxHeight, width, height, test.wantWidth, test.wantHeight)
+		}
+	}
+}
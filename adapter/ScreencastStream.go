@@ -0,0 +1,208 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"fmt"
+	"github.com/yezihack/e"
+	"log"
+	"net/http"
+	"sync"
+)
+
+const mjpegBoundary = "sonicScreencastFrame"
+
+// ScreencastStream serves the screencast as a multipart/x-mixed-replace MJPEG stream,
+// snapshots are polled only while at least one viewer is connected
+type ScreencastStream struct {
+	protocol  *protocolAdapter
+	quality   int
+	maxWidth  int
+	maxHeight int
+
+	lock    sync.Mutex
+	viewers map[*mjpegViewer]struct{}
+	// last JPEG sent, so a viewer joining a static page does not wait for a change
+	lastFrame []byte
+	// latest snapshot waiting to be encoded, older ones are replaced
+	snapshots   chan *screencastSnapshot
+	encoderStop chan struct{}
+}
+
+type mjpegViewer struct {
+	// latest JPEG waiting to be written, a slow viewer skips frames instead of slowing the others
+	frames chan []byte
+}
+
+type StreamOptFunc func(stream *ScreencastStream)
+
+func WithStreamQuality(quality int) StreamOptFunc {
+	return func(stream *ScreencastStream) {
+		stream.quality = quality
+	}
+}
+
+func WithStreamMaxSize(maxWidth int, maxHeight int) StreamOptFunc {
+	return func(stream *ScreencastStream) {
+		stream.maxWidth = maxWidth
+		stream.maxHeight = maxHeight
+	}
+}
+
+// NewScreencastStream returns an http.Handler streaming the page, it shares the snapshots with DevTools
+func (a *Adapter) NewScreencastStream(optFuncs ...StreamOptFunc) *ScreencastStream {
+	stream := &ScreencastStream{
+		protocol:  a.protocol,
+		quality:   defaultImageQuality,
+		viewers:   make(map[*mjpegViewer]struct{}),
+		snapshots: make(chan *screencastSnapshot, 1),
+	}
+	for _, optFunc := range optFuncs {
+		optFunc(stream)
+	}
+	return stream
+}
+
+func (s *ScreencastStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mjpegBoundary)
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	viewer := s.addViewer()
+	defer s.removeViewer(viewer)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case frame := <-viewer.frames:
+			if _, err := fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", mjpegBoundary, len(frame)); err != nil {
+				return
+			}
+			if _, err := w.Write(frame); err != nil {
+				return
+			}
+			if _, err := w.Write([]byte("\r\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// addViewer registers a viewer, the first one starts the encoder and subscribes to the screencast
+func (s *ScreencastStream) addViewer() *mjpegViewer {
+	viewer := &mjpegViewer{frames: make(chan []byte, 1)}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.viewers[viewer] = struct{}{}
+	if len(s.viewers) == 1 {
+		// drop what was left from a previous set of viewers
+		select {
+		case <-s.snapshots:
+		default:
+		}
+		s.encoderStop = make(chan struct{})
+		go s.encodeLoop(s.encoderStop)
+		s.protocol.acquireScreencast().addSink(s)
+	} else if s.lastFrame != nil {
+		viewer.frames <- s.lastFrame
+	}
+	return viewer
+}
+
+// removeViewer unregisters a viewer, the last one stops the polling
+func (s *ScreencastStream) removeViewer(viewer *mjpegViewer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.viewers, viewer)
+	if len(s.viewers) > 0 {
+		return
+	}
+	s.protocol.releaseScreencast(func(screencast *screencastSession) {
+		screencast.removeSink(s)
+	})
+	close(s.encoderStop)
+	s.lastFrame = nil
+}
+
+func (s *ScreencastStream) writeFrame(snapshot *screencastSnapshot) {
+	for {
+		select {
+		case s.snapshots <- snapshot:
+			return
+		default:
+		}
+		// the encoder is behind, replace the pending snapshot
+		select {
+		case <-s.snapshots:
+		default:
+		}
+	}
+}
+
+// encodeLoop encodes each snapshot once for every viewer
+func (s *ScreencastStream) encodeLoop(stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case snapshot := <-s.snapshots:
+			frame, err := s.encodeJPEG(snapshot)
+			if err != nil {
+				log.Println(e.Convert(err).ToStr())
+				continue
+			}
+			s.broadcast(frame)
+		}
+	}
+}
+
+func (s *ScreencastStream) encodeJPEG(snapshot *screencastSnapshot) ([]byte, error) {
+	img, err := snapshot.decode()
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	width, height := fitSize(bounds.Dx(), bounds.Dy(), s.maxWidth, s.maxHeight)
+	if width != bounds.Dx() || height != bounds.Dy() {
+		img = scaleImage(img, width, height)
+	}
+	return encodeImage(img, "jpeg", s.quality)
+}
+
+func (s *ScreencastStream) broadcast(frame []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.viewers) == 0 {
+		return
+	}
+	s.lastFrame = frame
+	for viewer := range s.viewers {
+		select {
+		case <-viewer.frames:
+		default:
+		}
+		viewer.frames <- frame
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"github.com/tidwall/gjson"
+	"time"
+)
+
+// Coordinate spaces of the screencast, following the metadata of Page.screencastFrame:
+//   - frame pixels: pixels of the encoded frame, frameScale frame pixels per DIP
+//   - DIP: the visual viewport as shown on the screen, deviceWidth x deviceHeight,
+//     this is what DevTools sends back in Input events once it removed its own zoom
+//   - client: CSS pixels of the layout viewport, used by elementFromPoint and MouseEvent.clientX,
+//     DIP divided by the pinch zoom (pageScaleFactor) plus the visual viewport offset
+//   - page: CSS pixels of the document, client plus the scroll offsets
+
+// viewportExpression measures the visual viewport, see screencastViewport
+const viewportExpression = `(function() {
+	const visual = window.visualViewport;
+	const scale = visual ? visual.scale : 1;
+	const width = visual ? visual.width : (window.innerWidth > 0 ? window.innerWidth : screen.width);
+	const height = visual ? visual.height : (window.innerHeight > 0 ? window.innerHeight : screen.height);
+	return {
+		width: width,
+		height: height,
+		pageScaleFactor: scale,
+		offsetLeft: visual ? visual.offsetLeft : 0,
+		offsetTop: visual ? visual.offsetTop : 0,
+		scrollOffsetX: window.pageXOffset,
+		scrollOffsetY: window.pageYOffset,
+		devicePixelRatio: window.devicePixelRatio,
+		visible: document.visibilityState !== 'hidden'
+	};
+})()`
+
+// screencastViewport is the geometry of the page when a frame was captured
+type screencastViewport struct {
+	// visual viewport in CSS pixels, the area snapshotted
+	width  float64
+	height float64
+	// pinch zoom, DIP per CSS pixel
+	pageScaleFactor float64
+	// position of the visual viewport in the layout viewport, CSS pixels
+	offsetLeft float64
+	offsetTop  float64
+	// scroll of the layout viewport, CSS pixels
+	scrollOffsetX float64
+	scrollOffsetY float64
+	// device pixels per CSS pixel at scale 1, snapshots are taken at this resolution
+	devicePixelRatio float64
+	// frame pixels per DIP of the frame sent to DevTools
+	frameScale float64
+}
+
+// identityViewport is used when no frame was sent, tool coordinates are then taken as client coordinates
+var identityViewport = screencastViewport{
+	pageScaleFactor:  1,
+	devicePixelRatio: 1,
+	frameScale:       1,
+}
+
+func parseScreencastViewport(value gjson.Result) screencastViewport {
+	viewport := screencastViewport{
+		width:            value.Get("width").Float(),
+		height:           value.Get("height").Float(),
+		pageScaleFactor:  value.Get("pageScaleFactor").Float(),
+		offsetLeft:       value.Get("offsetLeft").Float(),
+		offsetTop:        value.Get("offsetTop").Float(),
+		scrollOffsetX:    value.Get("scrollOffsetX").Float(),
+		scrollOffsetY:    value.Get("scrollOffsetY").Float(),
+		devicePixelRatio: value.Get("devicePixelRatio").Float(),
+		frameScale:       1,
+	}
+	if viewport.pageScaleFactor <= 0 {
+		viewport.pageScaleFactor = 1
+	}
+	if viewport.devicePixelRatio <= 0 {
+		viewport.devicePixelRatio = 1
+	}
+	return viewport
+}
+
+func (v screencastViewport) deviceWidth() float64 {
+	return v.width * v.pageScaleFactor
+}
+
+func (v screencastViewport) deviceHeight() float64 {
+	return v.height * v.pageScaleFactor
+}
+
+// dipToClient converts coordinates sent by DevTools into CSS pixels of the layout viewport
+func (v screencastViewport) dipToClient(x float64, y float64) (float64, float64) {
+	return x/v.pageScaleFactor + v.offsetLeft, y/v.pageScaleFactor + v.offsetTop
+}
+
+// metadata is the Page.screencastFrame metadata, offsetTop is the space above the page in the frame, always 0
+func (v screencastViewport) metadata(capturedAt time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"pageScaleFactor": v.pageScaleFactor,
+		"offsetTop":       0,
+		"deviceWidth":     v.deviceWidth(),
+		"deviceHeight":    v.deviceHeight(),
+		"scrollOffsetX":   v.scrollOffsetX,
+		"scrollOffsetY":   v.scrollOffsetY,
+		"timestamp":       float64(capturedAt.UnixNano()) / float64(time.Second),
+	}
+}
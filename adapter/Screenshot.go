@@ -0,0 +1,140 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"encoding/base64"
+	"github.com/tidwall/gjson"
+	"github.com/yezihack/e"
+	"log"
+	"math"
+)
+
+type snapshotRect struct {
+	x                float64
+	y                float64
+	width            float64
+	height           float64
+	coordinateSystem string
+}
+
+func (p *protocolAdapter) onCaptureScreenshot(message []byte) []byte {
+	msg := string(message)
+	id := int(gjson.Get(msg, "id").Int())
+	params := gjson.Get(msg, "params")
+	format := params.Get("format").String()
+	if format == "" {
+		format = "png"
+	}
+	quality := int(params.Get("quality").Int())
+	if format == "webp" && params.Get("quality").Exists() {
+		p.warnTool("Page.captureScreenshot: WebP screenshots are lossless, quality is ignored")
+	}
+
+	clip := params.Get("clip")
+	if clip.Exists() {
+		scale := 1.0
+		if clip.Get("scale").Exists() {
+			scale = clip.Get("scale").Float()
+		}
+		// clip is expressed in CSS pixels of the document
+		p.captureSnapshotRect(id, snapshotRect{
+			x:                clip.Get("x").Float(),
+			y:                clip.Get("y").Float(),
+			width:            clip.Get("width").Float(),
+			height:           clip.Get("height").Float(),
+			coordinateSystem: "Page",
+		}, format, quality, scale)
+		return nil
+	}
+
+	expression := `({width: window.innerWidth, height: window.innerHeight})`
+	coordinateSystem := "Viewport"
+	if params.Get("captureBeyondViewport").Bool() {
+		expression = `({width: Math.max(document.documentElement.scrollWidth, document.body ? document.body.scrollWidth : 0, window.innerWidth),
+			height: Math.max(document.documentElement.scrollHeight, document.body ? document.body.scrollHeight : 0, window.innerHeight)})`
+		coordinateSystem = "Page"
+	}
+	p.adapter.CallTarget("Runtime.evaluate", map[string]interface{}{
+		"expression":    expression,
+		"returnByValue": true,
+	}, func(result []byte) {
+		size := gjson.Get(string(result), "result.value")
+		if !size.Exists() {
+			p.adapter.FireErrorToTools(id, serverErrorCode, "Unable to measure the page")
+			return
+		}
+		p.captureSnapshotRect(id, snapshotRect{
+			width:            size.Get("width").Float(),
+			height:           size.Get("height").Float(),
+			coordinateSystem: coordinateSystem,
+		}, format, quality, 1)
+	})
+	return nil
+}
+
+func (p *protocolAdapter) captureSnapshotRect(id int, rect snapshotRect, format string, quality int, scale float64) {
+	if rect.width <= 0 || rect.height <= 0 {
+		p.adapter.FireErrorToTools(id, serverErrorCode, "Cannot take screenshot with 0 width or height")
+		return
+	}
+	params := map[string]interface{}{
+		"x":                int(math.Floor(rect.x)),
+		"y":                int(math.Floor(rect.y)),
+		"width":            int(math.Ceil(rect.width)),
+		"height":           int(math.Ceil(rect.height)),
+		"coordinateSystem": rect.coordinateSystem,
+	}
+	p.adapter.CallTarget("Page.snapshotRect", params, func(result []byte) {
+		dataURL := gjson.Get(string(result), "dataURL").String()
+		data, err := reencodeSnapshot(dataURL, format, quality, scale)
+		if err != nil {
+			log.Println(e.Convert(err).ToStr())
+			errorMessage := gjson.Get(string(result), "message").String()
+			if errorMessage == "" {
+				errorMessage = err.Error()
+			}
+			p.adapter.FireErrorToTools(id, serverErrorCode, "Unable to capture screenshot: "+errorMessage)
+			return
+		}
+		p.adapter.FireResultToTools(id, map[string]interface{}{
+			"data": data,
+		})
+	})
+}
+
+// reencodeSnapshot converts the PNG data URL of a WebKit snapshot into base64 data in the requested format
+func reencodeSnapshot(dataURL string, format string, quality int, scale float64) (string, error) {
+	if format == "png" && scale == 1 {
+		return splitDataURL(dataURL)
+	}
+	img, err := decodeDataURL(dataURL)
+	if err != nil {
+		return "", err
+	}
+	if scale > 0 && scale != 1 {
+		bounds := img.Bounds()
+		img = scaleImage(img,
+			int(math.Round(float64(bounds.Dx())*scale)),
+			int(math.Round(float64(bounds.Dy())*scale)))
+	}
+	data, err := encodeImage(img, format, quality)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
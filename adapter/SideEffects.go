@@ -0,0 +1,226 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"strings"
+	"unicode"
+)
+
+// punctuators of JavaScript, the longest first so that the first match is the right one
+var punctuators = []string{
+	">>>=", "...", "===", "!==", "**=", "<<=", ">>=", ">>>", "&&=", "||=", "??=",
+	"=>", "==", "!=", "<=", ">=", "&&", "||", "??", "?.", "++", "--", "+=", "-=", "*=", "/=", "%=", "&=", "|=", "^=", "**", "<<", ">>",
+	"+", "-", "*", "/", "%", "&", "|", "^", "!", "~", "<", ">", "=", "?", ":", ",", ";", ".", "(", ")", "[", "]", "{", "}",
+}
+
+var assignmentPunctuators = map[string]bool{
+	"=": true, "+=": true, "-=": true, "*=": true, "/=": true, "%=": true, "**=": true, "<<=": true, ">>=": true,
+	">>>=": true, "&=": true, "|=": true, "^=": true, "&&=": true, "||=": true, "??=": true, "++": true, "--": true,
+}
+
+// keywords that create objects, change bindings or run statements, a loop alone can hang the page
+var sideEffectKeywords = map[string]bool{
+	"new": true, "delete": true, "var": true, "let": true, "const": true, "function": true, "class": true,
+	"if": true, "for": true, "while": true, "do": true, "switch": true, "try": true, "catch": true, "finally": true,
+	"throw": true, "with": true, "import": true, "export": true, "debugger": true, "yield": true, "await": true,
+	"return": true, "async": true,
+}
+
+// keywords used as operators, a parenthesis after them is not a call
+var operatorKeywords = map[string]bool{
+	"typeof": true, "void": true, "in": true, "instanceof": true,
+}
+
+func isIdentifierStart(r rune) bool {
+	return r == '_' || r == '$' || r == '#' || unicode.IsLetter(r)
+}
+
+func isIdentifierPart(r rune) bool {
+	return isIdentifierStart(r) || unicode.IsDigit(r)
+}
+
+// hasSideEffects tells whether evaluating expression may change the page, for Runtime.evaluate with throwOnSideEffect.
+// It only accepts what it can read: no call, assignment, increment, spread, new, delete, statement or template
+// substitution.
+// Getters and the conversions of operands are implicit calls a static analysis cannot see.
+func hasSideEffects(expression string) bool {
+	source := []rune(expression)
+	// the previous token ends a value, a parenthesis or a template after it is a call
+	endsValue := false
+	// the previous token is . or ?., a keyword after it is a property name
+	propertyAccess := false
+	optionalChain := false
+	for i := 0; i < len(source); {
+		r := source[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '/' && i+1 < len(source) && source[i+1] == '/':
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+			continue
+		case r == '/' && i+1 < len(source) && source[i+1] == '*':
+			i += 2
+			for i+1 < len(source) && !(source[i] == '*' && source[i+1] == '/') {
+				i++
+			}
+			if i+1 >= len(source) {
+				return true
+			}
+			i += 2
+			continue
+		case r == '\'' || r == '"':
+			end, ok := skipString(source, i)
+			if !ok {
+				return true
+			}
+			i = end
+			endsValue, propertyAccess, optionalChain = true, false, false
+			continue
+		case r == '`':
+			if endsValue {
+				// tagged template
+				return true
+			}
+			end, ok := skipString(source, i)
+			if !ok || strings.Contains(string(source[i:end]), "${") {
+				return true
+			}
+			i = end
+			endsValue, propertyAccess, optionalChain = true, false, false
+			continue
+		case r == '/' && !endsValue:
+			end, ok := skipRegExp(source, i)
+			if !ok {
+				return true
+			}
+			i = end
+			endsValue, propertyAccess, optionalChain = true, false, false
+			continue
+		case unicode.IsDigit(r) || r == '.' && i+1 < len(source) && unicode.IsDigit(source[i+1]):
+			for i < len(source) && (isIdentifierPart(source[i]) || source[i] == '.') {
+				i++
+			}
+			endsValue, propertyAccess, optionalChain = true, false, false
+			continue
+		case isIdentifierStart(r):
+			start := i
+			for i < len(source) && isIdentifierPart(source[i]) {
+				i++
+			}
+			word := string(source[start:i])
+			if !propertyAccess && sideEffectKeywords[word] {
+				return true
+			}
+			endsValue = propertyAccess || !operatorKeywords[word]
+			propertyAccess, optionalChain = false, false
+			continue
+		}
+		punctuator := ""
+		for _, candidate := range punctuators {
+			if strings.HasPrefix(string(source[i:]), candidate) {
+				punctuator = candidate
+				break
+			}
+		}
+		// a spread runs the iterator protocol, it drains generators and iterators
+		if punctuator == "" || punctuator == "..." || assignmentPunctuators[punctuator] {
+			return true
+		}
+		if punctuator == "(" && (endsValue || optionalChain) {
+			return true
+		}
+		i += len([]rune(punctuator))
+		endsValue = punctuator == ")" || punctuator == "]" || punctuator == "}"
+		propertyAccess = punctuator == "." || punctuator == "?."
+		optionalChain = punctuator == "?."
+	}
+	return false
+}
+
+// skipString returns the index after the string or template starting at start
+func skipString(source []rune, start int) (int, bool) {
+	quote := source[start]
+	for i := start + 1; i < len(source); i++ {
+		switch source[i] {
+		case '\\':
+			i++
+		case quote:
+			return i + 1, true
+		case '\n':
+			if quote != '`' {
+				return 0, false
+			}
+		}
+	}
+	return 0, false
+}
+
+// skipRegExp returns the index after the regular expression literal starting at start, flags included
+func skipRegExp(source []rune, start int) (int, bool) {
+	inClass := false
+	for i := start + 1; i < len(source); i++ {
+		switch source[i] {
+		case '\\':
+			i++
+		case '[':
+			inClass = true
+		case ']':
+			inClass = false
+		case '\n':
+			return 0, false
+		case '/':
+			if inClass {
+				continue
+			}
+			i++
+			for i < len(source) && isIdentifierPart(source[i]) {
+				i++
+			}
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// replySideEffect answers an evaluation refused for its possible side effects the way V8 does, reason tells why
+// the adapter refused it when V8 would not
+func (p *protocolAdapter) replySideEffect(id int, reason string) {
+	description := "EvalError: Possible side-effect in debug-evaluate"
+	if reason != "" {
+		description += ": " + reason
+	}
+	exception := map[string]interface{}{
+		"type":        "object",
+		"subtype":     "error",
+		"className":   "EvalError",
+		"description": description,
+	}
+	p.adapter.FireResultToTools(id, map[string]interface{}{
+		"result": exception,
+		"exceptionDetails": map[string]interface{}{
+			"exceptionId":  p.runtime.exceptionId(),
+			"text":         "Uncaught",
+			"lineNumber":   0,
+			"columnNumber": 0,
+			"exception":    exception,
+		},
+	})
+}
@@ -0,0 +1,106 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import "testing"
+
+func TestHasSideEffects(t *testing.T) {
+	tests := []struct {
+		expression  string
+		sideEffects bool
+	}{
+		// reads
+		{"a", false},
+		{"a.b[c]", false},
+		{"a.b['c'].d", false},
+		{"typeof x", false},
+		{"void 0", false},
+		{"x ? 1 : 2", false},
+		{"a && b || !c", false},
+		{"a === b", false},
+		{"a >= b", false},
+		{"a?.b", false},
+		{"a?.[b]", false},
+		{"'a' in b", false},
+		{"a instanceof B", false},
+		{"[1, 2, 3]", false},
+		{"({a: 1})", false},
+		{"(a)", false},
+		{"`plain template`", false},
+		{"'a(b)'", false},
+		{"1.5e3 + .5", false},
+		{"a // b()", false},
+		{"a /* b() */", false},
+		{"a.delete", false},
+		{"a.new", false},
+		{"a?.delete", false},
+		// regular expression and division
+		{"/ab+c/g", false},
+		{"/[/]/.source", false},
+		{"a / b / c", false},
+		{"(a) / 2", false},
+		{"a[0] / 2", false},
+		// calls
+		{"a()", true},
+		{"a.b()", true},
+		{"a[b]()", true},
+		{"(a)()", true},
+		{"a?.()", true},
+		{"a?.b()", true},
+		{"/a/.test(b)", true},
+		{"typeof a()", true},
+		// object creation and deletion
+		{"new A", true},
+		{"new A()", true},
+		{"delete a.b", true},
+		// increments
+		{"a++", true},
+		{"--a", true},
+		// assignments
+		{"a = 1", true},
+		{"a.b = 1", true},
+		{"a += 1", true},
+		{"a -= 1", true},
+		{"a **= 2", true},
+		{"a >>>= 1", true},
+		{"a ||= b", true},
+		{"a ??= b", true},
+		// spread runs the iterator protocol
+		{"[...a]", true},
+		{"({...a})", true},
+		// templates
+		{"tag`text`", true},
+		{"a.b`text`", true},
+		{"`${a}`", true},
+		// statements
+		{"var a", true},
+		{"if (a) b", true},
+		{"while (true) {}", true},
+		{"function f() {}", true},
+		{"await a", true},
+		// what cannot be read
+		{"'unterminated", true},
+		{"/* unterminated", true},
+		{"/unterminated", true},
+		{"a @ b", true},
+	}
+	for _, test := range tests {
+		if got := hasSideEffects(test.expression); got != test.sideEffects {
+			t.Errorf("hasSideEffects(%q) = %v, want %v", test.expression, got, test.sideEffects)
+		}
+	}
+}
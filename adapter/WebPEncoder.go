@@ -0,0 +1,340 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+)
+
+// Minimal lossless WebP (VP8L) encoder, https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification
+// Pixels are written as literals with one prefix code per channel, no transforms and no backward references.
+// golang.org/x/image/webp only decodes, and the maintained encoders bind libwebp through cgo, which the cross
+// compiled builds of this adapter cannot link. The bitstream is small enough to own, the tests decode it with x/image.
+
+const vp8lMaxDimension = 1 << 14
+
+const vp8lMaxCodeLength = 15
+
+const vp8lMaxCodeLengthCodeLength = 7
+
+// green alphabet: 256 literals and 24 length prefixes, no color cache
+const vp8lGreenAlphabetSize = 256 + 24
+
+const vp8lDistanceAlphabetSize = 40
+
+var vp8lCodeLengthCodeOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+type vp8lBitWriter struct {
+	buffer []byte
+	bits   uint64
+	used   uint
+}
+
+// write appends the n low bits of value, least significant bit first
+func (w *vp8lBitWriter) write(value uint32, n uint) {
+	w.bits |= uint64(value) << w.used
+	w.used += n
+	for w.used >= 8 {
+		w.buffer = append(w.buffer, byte(w.bits))
+		w.bits >>= 8
+		w.used -= 8
+	}
+}
+
+func (w *vp8lBitWriter) flush() []byte {
+	if w.used > 0 {
+		w.buffer = append(w.buffer, byte(w.bits))
+		w.bits = 0
+		w.used = 0
+	}
+	return w.buffer
+}
+
+type vp8lPrefixCode struct {
+	lengths []int
+	codes   []uint32
+	// a code with a single symbol takes no bits in the stream
+	single bool
+}
+
+func newVP8LPrefixCode(histogram []int, maxLength int) *vp8lPrefixCode {
+	lengths := huffmanCodeLengths(histogram, maxLength)
+	used := 0
+	for _, length := range lengths {
+		if length > 0 {
+			used++
+		}
+	}
+	return &vp8lPrefixCode{
+		lengths: lengths,
+		codes:   canonicalHuffmanCodes(lengths),
+		single:  used <= 1,
+	}
+}
+
+// writeSymbol emits the code of symbol, prefix codes are read most significant bit first
+func (c *vp8lPrefixCode) writeSymbol(w *vp8lBitWriter, symbol int) {
+	if c.single {
+		return
+	}
+	length := c.lengths[symbol]
+	code := c.codes[symbol]
+	var reversed uint32
+	for i := 0; i < length; i++ {
+		reversed = reversed<<1 | (code>>uint(i))&1
+	}
+	w.write(reversed, uint(length))
+}
+
+// huffmanCodeLengths builds code lengths limited to maxLength bits, flattening the histogram until they fit
+func huffmanCodeLengths(histogram []int, maxLength int) []int {
+	counts := make([]int, len(histogram))
+	copy(counts, histogram)
+	for minCount := 1; ; minCount *= 2 {
+		lengths := unlimitedHuffmanCodeLengths(counts)
+		fits := true
+		for _, length := range lengths {
+			if length > maxLength {
+				fits = false
+				break
+			}
+		}
+		if fits {
+			return lengths
+		}
+		for symbol, count := range counts {
+			if count > 0 && count < minCount {
+				counts[symbol] = minCount
+			}
+		}
+	}
+}
+
+func unlimitedHuffmanCodeLengths(counts []int) []int {
+	type huffmanNode struct {
+		count  int
+		symbol int
+		left   int
+		right  int
+	}
+	lengths := make([]int, len(counts))
+	var nodes []huffmanNode
+	var active []int
+	for symbol, count := range counts {
+		if count > 0 {
+			nodes = append(nodes, huffmanNode{count: count, symbol: symbol, left: -1, right: -1})
+			active = append(active, len(nodes)-1)
+		}
+	}
+	if len(active) == 0 {
+		return lengths
+	}
+	if len(active) == 1 {
+		lengths[nodes[active[0]].symbol] = 1
+		return lengths
+	}
+	popSmallest := func() int {
+		smallest := 0
+		for i := 1; i < len(active); i++ {
+			if nodes[active[i]].count < nodes[active[smallest]].count {
+				smallest = i
+			}
+		}
+		node := active[smallest]
+		active = append(active[:smallest], active[smallest+1:]...)
+		return node
+	}
+	for len(active) > 1 {
+		left := popSmallest()
+		right := popSmallest()
+		nodes = append(nodes, huffmanNode{count: nodes[left].count + nodes[right].count, symbol: -1, left: left, right: right})
+		active = append(active, len(nodes)-1)
+	}
+	var walk func(node int, depth int)
+	walk = func(node int, depth int) {
+		if nodes[node].symbol >= 0 {
+			lengths[nodes[node].symbol] = depth
+			return
+		}
+		walk(nodes[node].left, depth+1)
+		walk(nodes[node].right, depth+1)
+	}
+	walk(active[0], 0)
+	return lengths
+}
+
+func canonicalHuffmanCodes(lengths []int) []uint32 {
+	var lengthCount [vp8lMaxCodeLength + 1]uint32
+	for _, length := range lengths {
+		if length > 0 {
+			lengthCount[length]++
+		}
+	}
+	var nextCode [vp8lMaxCodeLength + 1]uint32
+	var code uint32
+	for length := 1; length <= vp8lMaxCodeLength; length++ {
+		code = (code + lengthCount[length-1]) << 1
+		nextCode[length] = code
+	}
+	codes := make([]uint32, len(lengths))
+	for symbol, length := range lengths {
+		if length > 0 {
+			codes[symbol] = nextCode[length]
+			nextCode[length]++
+		}
+	}
+	return codes
+}
+
+// writePrefixCode stores a prefix code, as a simple code when it has at most two 8 bit symbols
+func writePrefixCode(w *vp8lBitWriter, histogram []int) *vp8lPrefixCode {
+	var symbols []int
+	for symbol, count := range histogram {
+		if count > 0 {
+			symbols = append(symbols, symbol)
+		}
+	}
+	if len(symbols) == 0 {
+		symbols = []int{0}
+	}
+	if len(symbols) <= 2 && symbols[len(symbols)-1] < 256 {
+		w.write(1, 1)
+		w.write(uint32(len(symbols)-1), 1)
+		if symbols[0] < 2 {
+			w.write(0, 1)
+			w.write(uint32(symbols[0]), 1)
+		} else {
+			w.write(1, 1)
+			w.write(uint32(symbols[0]), 8)
+		}
+		if len(symbols) == 2 {
+			w.write(uint32(symbols[1]), 8)
+		}
+		lengths := make([]int, len(histogram))
+		for _, symbol := range symbols {
+			lengths[symbol] = 1
+		}
+		return &vp8lPrefixCode{
+			lengths: lengths,
+			codes:   canonicalHuffmanCodes(lengths),
+			single:  len(symbols) == 1,
+		}
+	}
+
+	code := newVP8LPrefixCode(histogram, vp8lMaxCodeLength)
+	// normal code, the code lengths are themselves prefix coded
+	w.write(0, 1)
+	codeLengthHistogram := make([]int, len(vp8lCodeLengthCodeOrder))
+	for _, length := range code.lengths {
+		codeLengthHistogram[length]++
+	}
+	codeLengthCode := newVP8LPrefixCode(codeLengthHistogram, vp8lMaxCodeLengthCodeLength)
+	codeLengthCodes := len(vp8lCodeLengthCodeOrder)
+	for codeLengthCodes > 4 && codeLengthCode.lengths[vp8lCodeLengthCodeOrder[codeLengthCodes-1]] == 0 {
+		codeLengthCodes--
+	}
+	w.write(uint32(codeLengthCodes-4), 4)
+	for i := 0; i < codeLengthCodes; i++ {
+		w.write(uint32(codeLengthCode.lengths[vp8lCodeLengthCodeOrder[i]]), 3)
+	}
+	// every symbol of the alphabet is coded
+	w.write(0, 1)
+	for _, length := range code.lengths {
+		codeLengthCode.writeSymbol(w, length)
+	}
+	return code
+}
+
+func encodeWebPLossless(img *image.NRGBA) ([]byte, error) {
+	width := img.Rect.Dx()
+	height := img.Rect.Dy()
+	if width < 1 || height < 1 || width > vp8lMaxDimension || height > vp8lMaxDimension {
+		return nil, errors.New("image size is out of the WebP range")
+	}
+
+	green := make([]int, vp8lGreenAlphabetSize)
+	red := make([]int, 256)
+	blue := make([]int, 256)
+	alpha := make([]int, 256)
+	alphaIsUsed := false
+	for y := 0; y < height; y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+width*4]
+		for x := 0; x < len(row); x += 4 {
+			red[row[x]]++
+			green[row[x+1]]++
+			blue[row[x+2]]++
+			alpha[row[x+3]]++
+			if row[x+3] != 0xff {
+				alphaIsUsed = true
+			}
+		}
+	}
+
+	w := &vp8lBitWriter{}
+	w.write(0x2f, 8)
+	w.write(uint32(width-1), 14)
+	w.write(uint32(height-1), 14)
+	if alphaIsUsed {
+		w.write(1, 1)
+	} else {
+		w.write(0, 1)
+	}
+	// version
+	w.write(0, 3)
+	// no transform, no color cache, no meta prefix codes
+	w.write(0, 1)
+	w.write(0, 1)
+	w.write(0, 1)
+
+	greenCode := writePrefixCode(w, green)
+	redCode := writePrefixCode(w, red)
+	blueCode := writePrefixCode(w, blue)
+	alphaCode := writePrefixCode(w, alpha)
+	writePrefixCode(w, make([]int, vp8lDistanceAlphabetSize))
+
+	for y := 0; y < height; y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+width*4]
+		for x := 0; x < len(row); x += 4 {
+			greenCode.writeSymbol(w, int(row[x+1]))
+			redCode.writeSymbol(w, int(row[x]))
+			blueCode.writeSymbol(w, int(row[x+2]))
+			alphaCode.writeSymbol(w, int(row[x+3]))
+		}
+	}
+	data := w.flush()
+
+	chunkSize := len(data)
+	riffSize := 4 + 8 + chunkSize + chunkSize&1
+	output := make([]byte, 0, 8+riffSize)
+	output = append(output, "RIFF"...)
+	output = appendUint32LE(output, uint32(riffSize))
+	output = append(output, "WEBPVP8L"...)
+	output = appendUint32LE(output, uint32(chunkSize))
+	output = append(output, data...)
+	if chunkSize&1 == 1 {
+		output = append(output, 0)
+	}
+	return output, nil
+}
+
+func appendUint32LE(output []byte, value uint32) []byte {
+	var buffer [4]byte
+	binary.LittleEndian.PutUint32(buffer[:], value)
+	return append(output, buffer[:]...)
+}
@@ -0,0 +1,116 @@
+/*
+ *  Copyright (C) [SonicCloudOrg] Sonic Project
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *         http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package adapters
+
+import (
+	"bytes"
+	"golang.org/x/image/webp"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+func solidImage(width int, height int, c color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func gradientImage(width int, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 255 / width), G: uint8(y * 255 / height), B: uint8(x + y), A: 255})
+		}
+	}
+	return img
+}
+
+func noiseImage(width int, height int, seed int64) *image.NRGBA {
+	random := rand.New(rand.NewSource(seed))
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	random.Read(img.Pix)
+	return img
+}
+
+func TestEncodeWebPLosslessRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		img  *image.NRGBA
+	}{
+		{"single pixel", solidImage(1, 1, color.NRGBA{R: 12, G: 34, B: 56, A: 255})},
+		{"solid", solidImage(64, 32, color.NRGBA{R: 200, G: 100, B: 50, A: 255})},
+		{"transparent", solidImage(8, 8, color.NRGBA{})},
+		{"odd size gradient", gradientImage(17, 9)},
+		{"gradient", gradientImage(320, 240)},
+		{"noise with alpha", noiseImage(63, 47, 1)},
+		{"large noise", noiseImage(512, 300, 2)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := encodeWebPLossless(test.img)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			decoded, err := webp.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			assertSamePixels(t, test.img, decoded)
+		})
+	}
+}
+
+func TestEncodeImageWebP(t *testing.T) {
+	// any image type goes through the NRGBA conversion, quality has no effect
+	src := image.NewRGBA(image.Rect(0, 0, 10, 6))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i)
+	}
+	for i := 3; i < len(src.Pix); i += 4 {
+		src.Pix[i] = 255
+	}
+	data, err := encodeImage(src, "webp", 10)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	decoded, err := webp.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	assertSamePixels(t, toNRGBA(src), decoded)
+}
+
+func assertSamePixels(t *testing.T, want *image.NRGBA, got image.Image) {
+	t.Helper()
+	if got.Bounds().Dx() != want.Rect.Dx() || got.Bounds().Dy() != want.Rect.Dy() {
+		t.Fatalf("size %v, want %v", got.Bounds().Size(), want.Rect.Size())
+	}
+	gotNRGBA := toNRGBA(got)
+	for y := 0; y < want.Rect.Dy(); y++ {
+		for x := 0; x < want.Rect.Dx(); x++ {
+			if w, g := want.NRGBAAt(x, y), gotNRGBA.NRGBAAt(x, y); w != g {
+				t.Fatalf("pixel (%d, %d) is %v, want %v", x, y, g, w)
+			}
+		}
+	}
+}
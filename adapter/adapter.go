@@ -29,6 +29,9 @@ import (
 
 type MessageAdapters func(message []byte) []byte
 
+// serverErrorCode is the generic JSON-RPC error code DevTools expects for failed commands
+const serverErrorCode = -32000
+
 // todo OptimizationFocus
 type toolRequestSyncMap struct {
 	toolRequestMap sync.Map
@@ -110,6 +113,12 @@ type Adapter struct {
 	wsToolServer         *websocket.Conn
 	wsWebkitServer       *websocket.Conn
 	isToolConnect        bool
+	protocol             *protocolAdapter
+	// guards waitingForID, adapter requests are issued from timers as well
+	idLock sync.Mutex
+	// websocket connections support a single concurrent writer
+	webkitWriteLock  sync.Mutex
+	devToolWriteLock sync.Mutex
 	// 给iOS
 	sendWebkit func([]byte)
 	// 给devtool
@@ -129,7 +138,7 @@ func NewAdapter(wsToolServer *websocket.Conn, version string) *Adapter {
 	adapter.sendDevTool = adapter.defaultSendDevTool
 	adapter.receiveDevTool = adapter.defaultReceiveDevTool
 
-	initProtocolAdapter(adapter, version)
+	adapter.protocol = initProtocolAdapter(adapter, version)
 
 	return adapter
 }
@@ -143,18 +152,21 @@ func (a *Adapter) AddWebkitMessageFilter(method string, filter MessageAdapters)
 }
 
 func (a *Adapter) CallTarget(method string, params interface{}, callFunc func(message []byte)) {
+	a.idLock.Lock()
 	a.waitingForID -= 1
+	id := a.waitingForID
+	a.idLock.Unlock()
 	var message = &entity.TargetProtocol{}
 	arr, err := json.Marshal(params)
 	if err != nil {
 		log.Fatal(err)
 	}
 	println(string(arr))
-	message.ID = a.waitingForID
+	message.ID = id
 	message.Method = method
 	message.Params = params
 	if callFunc != nil {
-		a.adapterRequestMap.put(int64(a.waitingForID), callFunc)
+		a.adapterRequestMap.put(int64(id), callFunc)
 	}
 	a.sendToTarget(message)
 }
@@ -212,6 +224,21 @@ func (a *Adapter) FireResultToTools(id int, params interface{}) {
 	a.sendDevTool(arr)
 }
 
+func (a *Adapter) FireErrorToTools(id int, code int, errorMessage string) {
+	response := map[string]interface{}{
+		"id": id,
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": errorMessage,
+		},
+	}
+	arr, err := json.Marshal(response)
+	if err != nil {
+		log.Println(e.Convert(err).ToStr())
+	}
+	a.sendDevTool(arr)
+}
+
 func (a *Adapter) ReplyWithEmpty(msg string) []byte {
 	a.FireResultToTools(int(gjson.Get(msg, "id").Int()), map[string]interface{}{})
 	return nil
@@ -280,6 +307,8 @@ func (a *Adapter) defaultSendWebkit(message []byte) {
 	if message == nil {
 		return
 	}
+	a.webkitWriteLock.Lock()
+	defer a.webkitWriteLock.Unlock()
 	err := a.wsWebkitServer.WriteMessage(websocket.TextMessage, message)
 	if err != nil {
 		log.Println(e.Convert(err).ToStr())
@@ -351,6 +380,8 @@ func (a *Adapter) defaultSendDevTool(message []byte) {
 	if message == nil {
 		return
 	}
+	a.devToolWriteLock.Lock()
+	defer a.devToolWriteLock.Unlock()
 	err := a.wsToolServer.WriteMessage(websocket.TextMessage, message)
 	if err != nil {
 		log.Println(e.Convert(err).ToStr())
@@ -21,20 +21,28 @@ import (
 )
 
 type iOS12 struct {
-	adapter *Adapter
+	adapter  *Adapter
+	protocol *protocolAdapter
 }
 
 func initIOS12(protocol *protocolAdapter) {
 	protocol.adapter.SetTargetBased(true)
 	result := &iOS12{
-		adapter: protocol.adapter,
+		adapter:  protocol.adapter,
+		protocol: protocol,
 	}
 	//protocol.init()
 	protocol.adapter.AddWebkitMessageFilter("Target.targetCreated", result.targetCreated)
 	initIOS9(protocol)
 }
 
+// targetCreated follows the page target, workers are targets of their own the adapter does not attach to
 func (i *iOS12) targetCreated(message []byte) []byte {
+	switch gjson.Get(string(message), "params.targetInfo.type").String() {
+	case "worker", "service-worker", "serviceworker":
+		return message
+	}
 	i.adapter.SetTargetID(gjson.Get(string(message), "params.targetInfo.targetId").String())
+	i.protocol.onTargetCreated()
 	return message
 }
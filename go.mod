@@ -6,11 +6,12 @@ require (
 	github.com/gorilla/websocket v1.5.0
 	github.com/tidwall/gjson v1.14.3
 	github.com/tidwall/sjson v1.2.5
+	github.com/yezihack/e v1.0.0
+	golang.org/x/image v0.15.0
 )
 
 require (
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.0 // indirect
-	github.com/yezihack/e v1.0.0 // indirect
 )